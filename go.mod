@@ -1,3 +1,5 @@
 module github.com/gorilla/rpc
 
 go 1.13
+
+require github.com/gorilla/websocket v1.5.3
@@ -0,0 +1,84 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrMethodPanicked is the error of a request of a batch whose method
+// panicked. The panic is recovered so that the other requests of the batch
+// are still served.
+var ErrMethodPanicked = errors.New("rpc: method panicked")
+
+// ErrNotBatchable is the error of a request of a batch whose response can't
+// be part of a batch, e.g. a RawResponse.
+var ErrNotBatchable = errors.New("rpc: response can't be sent in a batch")
+
+type batchKey struct{}
+
+// isBatchRequest returns true if r is a request of a batch.
+func isBatchRequest(r *http.Request) bool {
+	return r.Context().Value(batchKey{}) != nil
+}
+
+// serveBatch serves the requests of a batch, up to batchConcurrency of them
+// at once, and writes their responses back together in the same order.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request, codec BatchCodec, requests []*http.Request) {
+	concurrency := s.batchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	responses := make([][]byte, len(requests))
+	for i, req := range requests {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, req *http.Request) {
+			defer func() {
+				if v := recover(); v != nil {
+					log.Printf("rpc: panic serving request of batch: %v\n%s", v, debug.Stack())
+				}
+				<-semaphore
+				wg.Done()
+			}()
+			rw := &batchResponseWriter{header: make(http.Header)}
+			s.serveRequest(rw, req.WithContext(context.WithValue(req.Context(), batchKey{}, true)), codec)
+			responses[i] = rw.body.Bytes()
+		}(i, req)
+	}
+	wg.Wait()
+
+	// Prevents Internet Explorer from MIME-sniffing a response away
+	// from the declared content-type
+	w.Header().Set("x-content-type-options", "nosniff")
+	codec.WriteBatch(w, r, responses)
+}
+
+// batchResponseWriter records the response of a request of a batch. Its
+// headers and status code are discarded.
+type batchResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {}
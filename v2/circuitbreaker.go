@@ -0,0 +1,119 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error of a call rejected because the circuit breaker
+// of its method is open, see WithCircuitBreaker.
+var ErrCircuitOpen = errors.New("rpc: circuit open")
+
+// CircuitBreakerConfig configures the circuit breaker of a method.
+type CircuitBreakerConfig struct {
+	// ErrorRate is the fraction of failed calls, between 0 and 1, above
+	// which the circuit opens.
+	ErrorRate float64
+	// MinCalls is the number of calls needed before the error rate is
+	// considered, so that a few early failures don't open the circuit.
+	MinCalls int
+	// Window is the period over which the error rate is measured. Zero
+	// means the calls are counted until the circuit opens.
+	Window time.Duration
+	// Cooldown is how long the circuit stays open. Once it is over, a
+	// single trial call is let through: the circuit closes again if it
+	// succeeds, and opens for another cooldown if it fails.
+	Cooldown time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fast-fails the calls to a method while it is failing.
+type circuitBreaker struct {
+	config      CircuitBreakerConfig
+	mutex       sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+	trialActive bool
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{config: config}
+}
+
+// allow returns true if a call can be made at the given time. A call that is
+// allowed must be followed by a call to done.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.config.Cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trialActive = true
+		return true
+	case circuitHalfOpen:
+		if b.trialActive {
+			return false
+		}
+		b.trialActive = true
+		return true
+	}
+	if b.config.Window > 0 && now.Sub(b.windowStart) >= b.config.Window {
+		b.reset(now)
+	}
+	return true
+}
+
+// done records the outcome of a call allowed at the given time.
+func (b *circuitBreaker) done(now time.Time, failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.trialActive = false
+		if failed {
+			b.state = circuitOpen
+			b.openedAt = now
+		} else {
+			b.state = circuitClosed
+			b.reset(now)
+		}
+		return
+	}
+	if b.state != circuitClosed {
+		return
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if b.calls >= b.config.MinCalls && float64(b.failures) >= b.config.ErrorRate*float64(b.calls) && b.failures > 0 {
+		b.state = circuitOpen
+		b.openedAt = now
+	}
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.windowStart = now
+	b.calls = 0
+	b.failures = 0
+}
@@ -0,0 +1,140 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// readCoalescer shares the execution of identical calls to read-only
+// methods made within a window of time.
+type readCoalescer struct {
+	window    time.Duration
+	methods   map[string]bool
+	mutex     sync.Mutex
+	calls     map[string]*coalescedCall
+	lastSweep time.Time
+}
+
+// coalescedCall is an execution shared by identical calls.
+type coalescedCall struct {
+	started time.Time
+	done    chan struct{}
+	reply   reflect.Value // a copy of the reply, owned by the coalescer
+	out     []reflect.Value
+}
+
+func newReadCoalescer(window time.Duration, methods []string) *readCoalescer {
+	c := &readCoalescer{
+		window:  window,
+		methods: make(map[string]bool, len(methods)),
+		calls:   make(map[string]*coalescedCall),
+	}
+	for _, method := range methods {
+		c.methods[method] = true
+	}
+	return c
+}
+
+// do calls fn to fill reply, unless an identical call, with the same key,
+// started less than window ago: its results are then shared, waiting for
+// them if needed. Each call gets its own deep copy of the shared reply, so
+// callers may modify their reply freely.
+func (c *readCoalescer) do(key string, now time.Time, reply reflect.Value, fn func() []reflect.Value) []reflect.Value {
+	c.mutex.Lock()
+	if call := c.calls[key]; call != nil && now.Sub(call.started) < c.window {
+		c.mutex.Unlock()
+		<-call.done
+		if call.reply.IsValid() {
+			reply.Elem().Set(deepCopy(call.reply.Elem()))
+		}
+		return call.out
+	}
+	if now.Sub(c.lastSweep) >= c.window {
+		for k, call := range c.calls {
+			if now.Sub(call.started) >= c.window {
+				delete(c.calls, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	call := &coalescedCall{started: now, done: make(chan struct{})}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		if call.out == nil {
+			// fn panicked.
+			call.out = []reflect.Value{reflect.ValueOf(ErrMethodPanicked)}
+		} else {
+			// Copied before the caller gets a chance to modify its reply.
+			call.reply = reflect.New(reply.Elem().Type())
+			call.reply.Elem().Set(deepCopy(reply.Elem()))
+		}
+		close(call.done)
+	}()
+	call.out = fn()
+	return call.out
+}
+
+// deepCopy returns a copy of v sharing no pointers, slices, maps or
+// interfaces with it. Unexported fields are copied shallowly, and cycles are
+// not supported.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				c.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrCostBudgetExceeded is the error of a call whose accumulated cost went
+// over the budget set with WithCostBudget.
+var ErrCostBudgetExceeded = errors.New("rpc: cost budget exceeded")
+
+type costKey struct{}
+
+// costAccumulator sums the cost reported for a call.
+type costAccumulator struct {
+	mutex  sync.Mutex
+	max    int
+	total  int
+	cancel context.CancelFunc
+}
+
+func (a *costAccumulator) add(n int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.total += n
+	if a.total > a.max {
+		a.cancel()
+		return ErrCostBudgetExceeded
+	}
+	return nil
+}
+
+func (a *costAccumulator) exceeded() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.total > a.max
+}
+
+// AddCost adds n cost units to the call served with ctx. Once the budget set
+// with WithCostBudget is exceeded, it returns ErrCostBudgetExceeded and ctx is
+// cancelled: the method should then stop, and the call fails with
+// ErrCostBudgetExceeded whatever the method returns.
+//
+// AddCost does nothing if no budget is set.
+func AddCost(ctx context.Context, n int) error {
+	if a, ok := ctx.Value(costKey{}).(*costAccumulator); ok {
+		return a.add(n)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotentResponse is the response of a request stored for its idempotency
+// key, see WithIdempotencyKeys.
+type IdempotentResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Fingerprint identifies the request the response is for, so that a key
+	// reused for another request is detected.
+	Fingerprint string
+}
+
+// IdempotencyStore stores responses by idempotency key. It must be safe for
+// concurrent use.
+type IdempotencyStore interface {
+	// Get returns the response stored for key, or nil if there is none.
+	Get(key string) *IdempotentResponse
+	// Set stores the response for key, for ttl.
+	Set(key string, res *IdempotentResponse, ttl time.Duration)
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore keeping responses in
+// memory.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{entries: make(map[string]*idempotencyEntry)}
+}
+
+// DefaultIdempotencyMaxBody is the default size above which the body of a
+// request carrying an idempotency key is rejected.
+const DefaultIdempotencyMaxBody = 1 << 20
+
+// idempotencySweepInterval is how often the expired responses are removed
+// from a memory store.
+const idempotencySweepInterval = time.Minute
+
+type memoryIdempotencyStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	res     *IdempotentResponse
+	expires time.Time
+}
+
+func (s *memoryIdempotencyStore) Get(key string) *IdempotentResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := s.entries[key]
+	if entry == nil || !time.Now().Before(entry.expires) {
+		return nil
+	}
+	return entry.res
+}
+
+func (s *memoryIdempotencyStore) Set(key string, res *IdempotentResponse, ttl time.Duration) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastSweep) >= idempotencySweepInterval {
+		s.lastSweep = now
+		for k, entry := range s.entries {
+			if !now.Before(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	s.entries[key] = &idempotencyEntry{res: res, expires: now.Add(ttl)}
+}
+
+// serveIdempotent serves r, carrying the given idempotency key, with serve
+// unless a response is stored for it. The key is scoped to the caller,
+// identified by the Authorization and Cookie headers, and identical requests
+// made concurrently are executed once.
+func (s *Server) serveIdempotent(w http.ResponseWriter, r *http.Request, key string, serve func(http.ResponseWriter, *http.Request)) {
+	var body []byte
+	if r.Body != nil {
+		max := s.idempotencyMaxBody
+		if max <= 0 {
+			max = DefaultIdempotencyMaxBody
+		}
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, max+1)); err != nil {
+			WriteError(w, http.StatusBadRequest, "rpc: failed to read request body")
+			return
+		}
+		if int64(len(body)) > max {
+			WriteError(w, http.StatusRequestEntityTooLarge, "rpc: request body too large for an Idempotency-Key")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	key = idempotencyHash(r.Header.Get("Authorization"), r.Header.Get("Cookie")) + ":" + key
+	fingerprint := idempotencyHash(r.Method, r.URL.String(), string(body))
+
+	for {
+		if res := s.idempotency.Get(key); res != nil {
+			if res.Fingerprint != fingerprint {
+				WriteError(w, http.StatusUnprocessableEntity, "rpc: Idempotency-Key reused for a different request")
+				return
+			}
+			writeIdempotentResponse(w, res)
+			return
+		}
+		done, reserved := s.idempotencyCalls.reserve(key)
+		if reserved {
+			break
+		}
+		// Wait for the response of the identical request in flight, or to
+		// execute the request if it isn't stored.
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	defer s.idempotencyCalls.release(key)
+
+	recorder := &idempotencyRecorder{ResponseWriter: w}
+	serve(recorder, r)
+	if res := recorder.response(); res.StatusCode < 500 {
+		res.Fingerprint = fingerprint
+		s.idempotency.Set(key, res, s.idempotencyTTL)
+	}
+}
+
+// idempotencyHash returns a hash of values.
+func idempotencyHash(values ...string) string {
+	h := sha256.New()
+	for _, value := range values {
+		h.Write([]byte(value))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyCalls tracks the requests being executed by idempotency key.
+type idempotencyCalls struct {
+	mutex sync.Mutex
+	calls map[string]chan struct{}
+}
+
+func newIdempotencyCalls() *idempotencyCalls {
+	return &idempotencyCalls{calls: make(map[string]chan struct{})}
+}
+
+// reserve returns true if no request with the given key is in flight, the
+// caller then executing it and calling release once done. Otherwise, it
+// returns a channel closed when the request in flight is done.
+func (c *idempotencyCalls) reserve(key string) (<-chan struct{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if done, ok := c.calls[key]; ok {
+		return done, false
+	}
+	c.calls[key] = make(chan struct{})
+	return nil, true
+}
+
+func (c *idempotencyCalls) release(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	close(c.calls[key])
+	delete(c.calls, key)
+}
+
+// writeIdempotentResponse writes a stored response back.
+func writeIdempotentResponse(w http.ResponseWriter, res *IdempotentResponse) {
+	for name, values := range res.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
+
+// idempotencyRecorder records the response written to its ResponseWriter.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// response returns the recorded response.
+func (w *idempotencyRecorder) response() *IdempotentResponse {
+	if w.status == 0 {
+		return &IdempotentResponse{
+			StatusCode: http.StatusOK,
+			Header:     w.ResponseWriter.Header().Clone(),
+		}
+	}
+	return &IdempotentResponse{
+		StatusCode: w.status,
+		Header:     w.header,
+		Body:       w.body.Bytes(),
+	}
+}
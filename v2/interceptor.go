@@ -0,0 +1,47 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// Handler serves a method call, returning its result.
+type Handler func(ctx context.Context, method string, params json.RawMessage) (interface{}, error)
+
+// Interceptor is called around a method call, see RegisterInterceptor. It
+// receives the resolved method name and the raw params, if the codec request
+// implements ParamsCodecRequest. It calls next to carry on with the call, or
+// returns without calling it to short-circuit the call, e.g. to reject it or
+// to return a cached result.
+type Interceptor func(ctx context.Context, method string, params json.RawMessage, next Handler) (interface{}, error)
+
+// intercept calls the method through the registered interceptors. invoke
+// calls the method itself, filling reply.
+func (s *Server) intercept(r *http.Request, codecReq CodecRequest, method string, reply reflect.Value, invoke func(*http.Request) []reflect.Value) (interface{}, error) {
+	var params json.RawMessage
+	if paramsReq, ok := codecReq.(ParamsCodecRequest); ok {
+		params = paramsReq.Params()
+	}
+
+	handler := func(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+		errValue := invoke(r.WithContext(ctx))
+		if err, _ := errValue[0].Interface().(error); err != nil {
+			return nil, err
+		}
+		return reply.Interface(), nil
+	}
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := s.interceptors[i], handler
+		handler = func(ctx context.Context, method string, params json.RawMessage) (interface{}, error) {
+			return interceptor(ctx, method, params, next)
+		}
+	}
+	return handler(r.Context(), method, params)
+}
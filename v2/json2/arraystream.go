@@ -0,0 +1,96 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"io"
+	"net/http"
+)
+
+// ArrayStream is a result written as a JSON array whose elements are
+// streamed as they are produced, instead of being held in memory. A method
+// returning one takes a reply argument of type *ArrayStream and sets it to a
+// function calling emit once per element:
+//
+//	func (s *Service) List(r *http.Request, args *Args, reply *json2.ArrayStream) error {
+//		*reply = func(emit func(interface{}) error) error {
+//			for _, item := range s.items {
+//				if err := emit(item); err != nil {
+//					return err
+//				}
+//			}
+//			return nil
+//		}
+//		return nil
+//	}
+//
+// The function is called once the response has started, so an error it
+// returns can't be sent to the client: the response is then left unfinished,
+// and invalid, rather than passed off as a complete result.
+type ArrayStream func(emit func(element interface{}) error) error
+
+// writeArrayStream writes a response whose result is the array streamed by
+// stream.
+func (c *CodecRequest) writeArrayStream(w http.ResponseWriter, stream ArrayStream) {
+	if c.msgpack {
+		// MessagePack arrays are prefixed with their length.
+		var elements []interface{}
+		err := stream(func(element interface{}) error {
+			elements = append(elements, element)
+			return nil
+		})
+		if err != nil {
+			c.WriteError(c.httpRequest.Context(), w, 400, err)
+			return
+		}
+		c.WriteResponse(w, &elements)
+		return
+	}
+	// Notifications don't get a response, but the stream is still drained
+	// so that its producer completes.
+	if c.request.Id == nil {
+		stream(func(interface{}) error { return nil })
+		c.reportCall(0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	encoder := c.newEncoder(w)
+	first := true
+	err := writeString(w, `{"jsonrpc":"`+Version+`","result":[`)
+	if err == nil {
+		err = stream(func(element interface{}) error {
+			if !first {
+				if err := writeString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			if err := encoder.Encode(element); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = writeString(w, `],"id":`+string(*c.request.Id)+"}\n")
+	}
+	if err != nil {
+		c.logf("json2: failed to stream result of method %q: %s", c.request.Method, err)
+		c.reportCall(E_SERVER)
+		return
+	}
+	c.reportCall(0)
+}
+
+func writeString(w io.Writer, s string) error {
+	_, err := io.WriteString(w, s)
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// SplitBatch returns a request per element of the batch sent in r, a JSON
+// array of requests. An empty array is not a batch: it is served alone and
+// rejected as an invalid request. Batches are not supported by MessagePack
+// codecs, nor with streamed payloads.
+//
+// A GET request, see rpc.WithGetMethods, is a batch of the calls listed in its
+// query by repeated "method" and "params" parameters, e.g.
+// "?method=a&params=[1]&method=b&params={}". Their ids are their positions
+// in the batch. A call whose params are not a JSON array or object is
+// answered with an invalid request error.
+func (c *Codec) SplitBatch(r *http.Request) ([]*http.Request, bool) {
+	if c.msgpack || (c.streamedPayloads && r.Header.Get(EnvelopeLengthHeader) != "") {
+		return nil, false
+	}
+	if r.Method == "GET" {
+		return splitGetBatch(r)
+	}
+	if c.decompressBodies {
+		if err := decompressBody(r); err != nil {
+			return nil, false
+		}
+	}
+	body, err := readLimited(r.Body, c.maxRequestBytes)
+	if err == errRequestTooLarge {
+		// Put back what was read, the request is rejected when served
+		// alone.
+		r.Body = &readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if c.stripBOM {
+		body = bytes.TrimPrefix(body, utf8BOM)
+	}
+	if err != nil || !isJSONArray(body) {
+		return nil, false
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil || len(elements) == 0 {
+		return nil, false
+	}
+
+	requests := make([]*http.Request, len(elements))
+	for i, element := range elements {
+		req := r.Clone(context.WithValue(r.Context(), batchElementKey{}, true))
+		// The batch response is encoded as a whole, not each of its
+		// elements.
+		req.Header.Del("Accept-Encoding")
+		req.Body = ioutil.NopCloser(bytes.NewReader(element))
+		req.ContentLength = int64(len(element))
+		requests[i] = req
+	}
+	return requests, true
+}
+
+// batchElementKey is the context key marking the requests of a batch.
+type batchElementKey struct{}
+
+// inBatch returns true if the request is part of a batch.
+func (c *CodecRequest) inBatch() bool {
+	return c.httpRequest.Context().Value(batchElementKey{}) != nil
+}
+
+// splitGetBatch returns a request per call listed in the query of r.
+func splitGetBatch(r *http.Request) ([]*http.Request, bool) {
+	query := r.URL.Query()
+	methods, params := query["method"], query["params"]
+	if len(methods) == 0 || (len(params) != 0 && len(params) != len(methods)) {
+		return nil, false
+	}
+
+	requests := make([]*http.Request, len(methods))
+	for i, method := range methods {
+		ctx := context.WithValue(r.Context(), batchElementKey{}, true)
+		element := &clientRequest{
+			Version: Version,
+			Method:  method,
+			Id:      json.RawMessage(strconv.Itoa(i)),
+		}
+		if len(params) != 0 && params[i] != "" {
+			if p := []byte(params[i]); json.Valid(p) && (isJSONArray(p) || isJSONObject(p)) {
+				element.Params = json.RawMessage(p)
+			} else {
+				// The call is rejected when served.
+				ctx = context.WithValue(ctx, invalidGetParamsKey{}, true)
+			}
+		}
+		body, err := json.Marshal(element)
+		if err != nil {
+			return nil, false
+		}
+
+		req := r.Clone(ctx)
+		req.Header.Del("Accept-Encoding")
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		requests[i] = req
+	}
+	return requests, true
+}
+
+// invalidGetParamsKey is the context key marking the calls of a GET batch
+// whose params are not a JSON array or object.
+type invalidGetParamsKey struct{}
+
+// WriteBatch writes the responses of a batch as a JSON array, leaving out the
+// empty responses of notifications. Nothing is written if all the requests
+// of the batch are notifications.
+func (c *Codec) WriteBatch(w http.ResponseWriter, r *http.Request, responses [][]byte) {
+	var buf bytes.Buffer
+	for _, res := range responses {
+		res = bytes.TrimSpace(res)
+		if len(res) == 0 {
+			continue
+		}
+		if !json.Valid(res) {
+			// Unbatchable responses are rejected with their request id by
+			// the requests themselves, see rpc.ErrNotBatchable; this only
+			// guards against codecs writing something else.
+			res, _ = json.Marshal(&serverResponse{
+				Version: Version,
+				Error: &Error{
+					Code:    E_INTERNAL,
+					Message: "response can't be sent in a batch",
+				},
+			})
+		}
+		if buf.Len() == 0 {
+			buf.WriteByte('[')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.Write(res)
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	buf.WriteString("]\n")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if c.servedBy != "" {
+		w.Header().Set("X-Served-By", c.servedBy)
+	}
+	c.encoderSelector.Select(r).Encode(w).Write(buf.Bytes())
+}
@@ -6,9 +6,15 @@
 package json2
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"strconv"
 )
 
 // ----------------------------------------------------------------------------
@@ -26,9 +32,9 @@ type clientRequest struct {
 	// Object to pass as request parameter to the method.
 	Params interface{} `json:"params"`
 
-	// The request id. This can be of any type. It is used to match the
-	// response with the request that it is replying to.
-	Id uint64 `json:"id"`
+	// The request id. This can be a string, a number or null. It is used to
+	// match the response with the request that it is replying to.
+	Id json.RawMessage `json:"id"`
 }
 
 // clientResponse represents a JSON-RPC response returned to a client.
@@ -44,11 +50,63 @@ func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
 		Version: "2.0",
 		Method:  method,
 		Params:  args,
-		Id:      uint64(rand.Int63()),
+		Id:      newID(),
 	}
 	return json.Marshal(c)
 }
 
+// ClientCall is a call of a batch, see EncodeClientRequestBatch.
+type ClientCall struct {
+	Method string
+	Params interface{}
+	// The request id, used to match the call with its response: a JSON
+	// string or number. An id from IDGenerator is used when it is nil.
+	Id json.RawMessage
+}
+
+// EncodeClientRequestBatch encodes several calls as a single JSON-RPC batch
+// request. The ids generated for the calls are stored in calls, as responses
+// of a batch can come back in any order.
+func EncodeClientRequestBatch(calls []ClientCall) ([]byte, error) {
+	batch := make([]*clientRequest, len(calls))
+	ids := make(map[string]bool, len(calls))
+	for i := range calls {
+		if calls[i].Id != nil && ids[string(calls[i].Id)] {
+			return nil, fmt.Errorf("json2: duplicate id %s in batch", calls[i].Id)
+		}
+		ids[string(calls[i].Id)] = true
+	}
+	for i := range calls {
+		if calls[i].Id == nil {
+			calls[i].Id = newID()
+			if ids[string(calls[i].Id)] {
+				return nil, fmt.Errorf("json2: duplicate generated id %s in batch", calls[i].Id)
+			}
+			ids[string(calls[i].Id)] = true
+		}
+		batch[i] = &clientRequest{
+			Version: "2.0",
+			Method:  calls[i].Method,
+			Params:  calls[i].Params,
+			Id:      calls[i].Id,
+		}
+	}
+	return json.Marshal(batch)
+}
+
+// IDGenerator returns the ids of the requests encoded by EncodeClientRequest
+// and EncodeClientRequestBatch, random numbers by default. It can be replaced
+// to get predictable ids, e.g. from a counter, and must then be safe for
+// concurrent use.
+var IDGenerator = func() uint64 {
+	return uint64(rand.Int63())
+}
+
+// newID returns a new numeric request id.
+func newID() json.RawMessage {
+	return json.RawMessage(strconv.FormatUint(IDGenerator(), 10))
+}
+
 // DecodeClientResponse decodes the response body of a client request into
 // the interface reply.
 func DecodeClientResponse(r io.Reader, reply interface{}) error {
@@ -64,6 +122,12 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 				Message: string(*c.Error),
 			}
 		}
+		var raw struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if json.Unmarshal(*c.Error, &raw) == nil && len(raw.Data) > 0 {
+			jsonErr.rawData = raw.Data
+		}
 		return jsonErr
 	}
 
@@ -73,3 +137,78 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 
 	return json.Unmarshal(*c.Result, reply)
 }
+
+// ----------------------------------------------------------------------------
+// Client
+// ----------------------------------------------------------------------------
+
+// HTTPError is the error of a call whose HTTP response isn't a 200 OK, so
+// that it can't hold a JSON-RPC response, e.g. when the server rejects the
+// request before reaching the codec.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	// Body is the beginning of the response body.
+	Body []byte
+}
+
+func (e *HTTPError) Error() string {
+	if len(e.Body) == 0 {
+		return "json2: HTTP status " + e.Status
+	}
+	return fmt.Sprintf("json2: HTTP status %s: %s", e.Status, bytes.TrimSpace(e.Body))
+}
+
+// maxErrorBody is the number of bytes of a response body kept in an
+// HTTPError.
+const maxErrorBody = 1024
+
+// Client calls the methods of a JSON-RPC server over HTTP.
+type Client struct {
+	// Endpoint is the URL the requests are posted to.
+	Endpoint string
+	// HTTPClient sends the requests. http.DefaultClient is used when nil.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client posting its requests to endpoint.
+func NewClient(endpoint string) *Client {
+	return &Client{Endpoint: endpoint}
+}
+
+// Call calls method with args and decodes its result into reply.
+//
+// A JSON-RPC error returned by the method is returned as an *Error, and a
+// response that isn't a 200 OK as an *HTTPError. The call is aborted when
+// ctx is done.
+func (c *Client) Call(ctx context.Context, method string, args, reply interface{}) error {
+	body, err := EncodeClientRequest(method, args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       body,
+		}
+	}
+	return DecodeClientResponse(resp.Body, reply)
+}
@@ -6,7 +6,10 @@
 package json2
 
 import (
+	"encoding/json"
 	"errors"
+	"strings"
+	"time"
 )
 
 type ErrorCode int
@@ -18,8 +21,41 @@ const (
 	E_BAD_PARAMS  ErrorCode = -32602
 	E_INTERNAL    ErrorCode = -32603
 	E_SERVER      ErrorCode = -32000
+
+	E_NOT_MODIFIED   ErrorCode = -32097
+	E_METHOD_REMOVED ErrorCode = -32096
+	E_RETRYABLE      ErrorCode = -32095
+	E_TIMEOUT        ErrorCode = -32094
+	E_TOO_LARGE      ErrorCode = -32093
+	E_RATE_LIMITED   ErrorCode = -32092
 )
 
+// errorMessages holds the canonical message of each error code.
+var errorMessages = map[ErrorCode]string{
+	E_PARSE:          "Parse error",
+	E_INVALID_REQ:    "Invalid Request",
+	E_NO_METHOD:      "Method not found",
+	E_BAD_PARAMS:     "Invalid params",
+	E_INTERNAL:       "Internal error",
+	E_SERVER:         "Server error",
+	E_NOT_MODIFIED:   "Not modified",
+	E_METHOD_REMOVED: "Method removed",
+	E_RETRYABLE:      "Retryable error",
+	E_TIMEOUT:        "Timeout",
+	E_TOO_LARGE:      "Request too large",
+	E_RATE_LIMITED:   "Rate limited",
+}
+
+// ErrorCodes returns the error codes used by the codec, mapped to their
+// canonical message.
+func ErrorCodes() map[int]string {
+	codes := make(map[int]string, len(errorMessages))
+	for code, message := range errorMessages {
+		codes[int(code)] = message
+	}
+	return codes
+}
+
 var ErrNullResult = errors.New("result is null")
 
 type Error struct {
@@ -32,8 +68,88 @@ type Error struct {
 
 	// A Primitive or Structured value that contains additional information about the error.
 	Data interface{} `json:"data,omitempty"` /* optional */
+
+	// The underlying error, if any. It is never sent to the client.
+	cause error
+
+	// The data as received by DecodeClientResponse.
+	rawData json.RawMessage
+}
+
+// WrapError returns an Error retaining cause as its underlying error, so
+// that errors.Is and errors.As can inspect it server-side.
+func WrapError(code ErrorCode, message string, cause error) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+		cause:   cause,
+	}
+}
+
+// NotModifiedError returns the error a method returns to tell a polling
+// client that nothing changed since its last call, so that it keeps its
+// cached value. This is different from a null result.
+func NotModifiedError() *Error {
+	return &Error{
+		Code:    E_NOT_MODIFIED,
+		Message: "not modified",
+	}
+}
+
+// RetryInfo is the data of an E_RETRYABLE error.
+type RetryInfo struct {
+	// Seconds to wait before retrying.
+	After float64 `json:"after"`
+}
+
+// RetryableError returns the error a method returns on a transient failure,
+// telling the client to retry after the given duration. Its response also
+// carries a matching "Retry-After" header.
+func RetryableError(after time.Duration) *Error {
+	return &Error{
+		Code:    E_RETRYABLE,
+		Message: "temporarily unavailable, retry later",
+		Data:    &RetryInfo{After: after.Seconds()},
+	}
+}
+
+// FieldError reports an invalid field of the params.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is the error Validatable.Validate returns to report several
+// invalid fields. The fields are then listed in the data of the E_BAD_PARAMS
+// error.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Field + ": " + err.Message
+	}
+	return strings.Join(messages, "; ")
 }
 
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// ToError returns e, so that a service method can panic with an *Error to
+// have it written as its result.
+func (e *Error) ToError() *Error {
+	return e
+}
+
+// RawData returns the data of an error decoded by DecodeClientResponse, as
+// sent by the server, e.g. to unmarshal it into a specific type. It is nil if
+// the error has no data.
+func (e *Error) RawData() json.RawMessage {
+	return e.rawData
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,20 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// FixedDecimal returns a float format, see WithFloatFormat, encoding floats
+// without exponent and with the given number of decimals, e.g. 1000000.00
+// instead of 1e+06 for 2 decimals.
+func FixedDecimal(decimals int) func(float64) json.RawMessage {
+	return func(f float64) json.RawMessage {
+		return json.RawMessage(strconv.FormatFloat(f, 'f', decimals, 64))
+	}
+}
@@ -7,12 +7,26 @@ package json2
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
 )
@@ -116,6 +130,18 @@ func (t *Service1) MappedResponseError(r *http.Request, req *Service1Request, re
 	return ErrMappedResponseError
 }
 
+type Item struct {
+	Name     string
+	Quantity int
+}
+
+func (t *Service1) BulkInsert(r *http.Request, req *[]Item, res *Service1Response) error {
+	for _, item := range *req {
+		res.Result += item.Quantity
+	}
+	return nil
+}
+
 func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) error {
 	if !s.HasMethod(method) {
 		t.Fatal("Expected to be registered:", method)
@@ -286,3 +312,2811 @@ func TestDecodeNullResult(t *testing.T) {
 		t.Error("Expected result to be nil, but got:", result)
 	}
 }
+
+// spoolDirRecorder records the number of files in dir when the body is
+// written.
+type spoolDirRecorder struct {
+	*ResponseRecorder
+	dir     string
+	spooled int
+}
+
+func (w *spoolDirRecorder) Write(p []byte) (int, error) {
+	if files, err := ioutil.ReadDir(w.dir); err == nil && w.spooled == 0 {
+		w.spooled = len(files)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestResultSpoolThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "json2-spool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	codec := NewCustomCodec(WithResultSpoolThreshold(16))
+	codec.spoolDir = dir
+
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := &spoolDirRecorder{ResponseRecorder: NewRecorder(), dir: dir}
+	s.ServeHTTP(w, r)
+
+	if w.spooled != 1 {
+		t.Errorf("Expected 1 spool file while writing the response, but found %d", w.spooled)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected spool files to be removed, but found %d", len(files))
+	}
+
+	// Array results reach the spool one element at a time.
+	service := &SpoolService{dir: dir}
+	s.RegisterService(service, "")
+	buf, _ = EncodeClientRequest("SpoolService.List", &Service1Request{A: 3})
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w = &spoolDirRecorder{ResponseRecorder: NewRecorder(), dir: dir}
+	s.ServeHTTP(w, r)
+
+	var elements []int
+	if err := DecodeClientResponse(w.Body, &elements); err != nil || len(elements) != 3 || elements[2] != 2 {
+		t.Errorf("Expected 3 elements, but got %v, err: %v", elements, err)
+	}
+	if len(service.sizes) != 3 || service.sizes[0] >= service.sizes[1] || service.sizes[1] >= service.sizes[2] {
+		t.Errorf("Expected the spool to grow between elements, but got sizes %v", service.sizes)
+	}
+}
+
+// SpoolService returns elements recording the size of the spool file in dir
+// when they are encoded.
+type SpoolService struct {
+	dir   string
+	sizes []int64
+}
+
+type spoolElement struct {
+	service *SpoolService
+	i       int
+}
+
+func (e spoolElement) MarshalJSON() ([]byte, error) {
+	if files, err := ioutil.ReadDir(e.service.dir); err == nil && len(files) == 1 {
+		e.service.sizes = append(e.service.sizes, files[0].Size())
+	}
+	return json.Marshal(e.i)
+}
+
+func (s *SpoolService) List(r *http.Request, req *Service1Request, res *[]spoolElement) error {
+	for i := 0; i < req.A; i++ {
+		*res = append(*res, spoolElement{s, i})
+	}
+	return nil
+}
+
+func TestServedByHeader(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip("hostname unavailable:", err)
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithServedByHeader(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if got := w.HeaderMap.Get("X-Served-By"); got != hostname {
+		t.Errorf("Expected X-Served-By to be %q, but got %q", hostname, got)
+	}
+}
+
+func TestBulkParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	items := []Item{{"a", 2}, {"b", 3}}
+	if err := execute(t, s, "Service1.BulkInsert", items, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 5 {
+		t.Errorf("Wrong response: got %v, want %v", res.Result, 5)
+	}
+
+	// Elements that can't be decoded into Item are rejected, not re-mapped.
+	res = Service1Response{}
+	if err := execute(t, s, "Service1.BulkInsert", []interface{}{1, "b"}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_INVALID_REQ {
+		t.Errorf("Expected to receive an E_INVALID_REQ error, but got %v", err)
+	}
+}
+
+func TestMethodSchema(t *testing.T) {
+	paramsSchema := []byte(`{"type": "object", "properties": {"A": {"type": "integer", "minimum": 0}}}`)
+	resultSchema := []byte(`{"type": "object", "properties": {"Result": {"type": "integer", "maximum": 100}}}`)
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(
+		WithMethodSchema("Service1.Multiply", paramsSchema, resultSchema),
+		StrictResultSchema(),
+		WithLogger(log.New(ioutil.Discard, "", 0)),
+	), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{-4, 2}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to receive an E_BAD_PARAMS error, but got %v", err)
+	}
+
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{40, 20}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_SERVER {
+		t.Errorf("Expected to receive an E_SERVER error, but got %v", err)
+	}
+}
+
+type DryRunRequest struct {
+	A int
+}
+
+func (r *DryRunRequest) Validate() error {
+	if r.A < 0 {
+		return errors.New("A must be positive")
+	}
+	return nil
+}
+
+type DryRunService struct {
+	calls int
+}
+
+func (s *DryRunService) Call(r *http.Request, req *DryRunRequest, res *Service1Response) error {
+	s.calls++
+	res.Result = req.A
+	return nil
+}
+
+func TestDryRunHeader(t *testing.T) {
+	service := new(DryRunService)
+	s := rpc.NewServer(rpc.WithDryRunHeader("X-Dry-Run"))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(service, "")
+
+	post := func(a int, dryRun string) *ResponseRecorder {
+		buf, _ := EncodeClientRequest("DryRunService.Call", &DryRunRequest{a})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Dry-Run", dryRun)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	var res interface{}
+	if err := DecodeClientResponse(post(1, "true").Body, &res); err != ErrNullResult {
+		t.Errorf("Expected to get ErrNullResult, but got %v", err)
+	}
+	if service.calls != 0 {
+		t.Errorf("Expected the method not to be invoked, but it was invoked %d times", service.calls)
+	}
+
+	if err := DecodeClientResponse(post(-1, "true").Body, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to receive an E_BAD_PARAMS error, but got %v", err)
+	}
+
+	// Outside of dry runs, args are only validated with WithValidation.
+	if err := DecodeClientResponse(post(-1, "").Body, &res); err != nil {
+		t.Errorf("Expected the args not to be validated, but got %v", err)
+	}
+	if service.calls != 1 {
+		t.Errorf("Expected the method to be invoked once, but it was invoked %d times", service.calls)
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	err := error(WrapError(E_SERVER, "wrapped", fmt.Errorf("context: %w", sentinel)))
+
+	if !errors.Is(err, sentinel) {
+		t.Error("Expected errors.Is to find the wrapped sentinel")
+	}
+
+	data, _ := json.Marshal(err)
+	if strings.Contains(string(data), "context") {
+		t.Errorf("Expected the cause not to be serialized, but got %s", data)
+	}
+}
+
+func TestErrorResponseHeaders(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithErrorResponseHeaders(http.Header{
+		"Cache-Control": {"no-store"},
+	})), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(method string) *ResponseRecorder {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if got := post("Service1.ResponseError").HeaderMap.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Expected Cache-Control to be %q on error, but got %q", "no-store", got)
+	}
+	if got := post("Service1.Multiply").HeaderMap.Get("Cache-Control"); got != "" {
+		t.Errorf("Expected no Cache-Control on success, but got %q", got)
+	}
+}
+
+type TimeResponse struct {
+	CreatedAt time.Time
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Name      string     `json:"name"`
+}
+
+type TimeService struct{}
+
+var knownTime = time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)
+
+func (s *TimeService) Get(r *http.Request, req *struct{}, res *TimeResponse) error {
+	res.CreatedAt = knownTime
+	res.Name = "known"
+	return nil
+}
+
+func TestTimeFormat(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithTimeFormat(TimeFormatUnixMillis)), "application/json")
+	s.RegisterService(new(TimeService), "")
+
+	var res map[string]interface{}
+	if err := execute(t, s, "TimeService.Get", struct{}{}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if got, want := res["CreatedAt"], float64(1577934245678); got != want {
+		t.Errorf("Expected CreatedAt to be %v, but got %v", want, got)
+	}
+	if _, ok := res["updated_at"]; ok {
+		t.Error("Expected updated_at to be omitted")
+	}
+	if got := res["name"]; got != "known" {
+		t.Errorf("Expected name to be %q, but got %v", "known", got)
+	}
+}
+
+type TextValue struct {
+	X string
+}
+
+func (v TextValue) MarshalText() ([]byte, error) {
+	return []byte("T:" + v.X), nil
+}
+
+type CustomValue struct{}
+
+func (v *CustomValue) MarshalJSON() ([]byte, error) {
+	return []byte(`"custom"`), nil
+}
+
+type FormatInner struct {
+	Name string
+	At   time.Time
+}
+
+type FormatNode struct {
+	At       time.Time
+	Children []FormatNode `json:",omitempty"`
+}
+
+type FormatWrapper struct {
+	Custom CustomValue
+}
+
+type FormatResult struct {
+	FormatInner
+	Wrapper FormatWrapper
+	Name    string
+	Count   int `json:",string"`
+	Text    TextValue
+	Custom  CustomValue
+	Ratio   float64 `json:",omitempty"`
+	Tree    FormatNode
+	Any     interface{}
+	private time.Time
+}
+
+func TestTimeFormatEncodingRules(t *testing.T) {
+	at := time.Unix(1577934245, 0)
+	res := &FormatResult{
+		FormatInner: FormatInner{Name: "inner", At: at},
+		Name:        "outer",
+		Count:       5,
+		Text:        TextValue{"x"},
+		Tree:        FormatNode{At: at, Children: []FormatNode{{At: at}}},
+		Any:         map[string]interface{}{"at": at},
+		private:     at,
+	}
+	data, err := json.Marshal(formatResult(reflect.ValueOf(res), &resultFormat{time: TimeFormatUnixSeconds}))
+	if err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	want := `{"At":1577934245,"Wrapper":{"Custom":"custom"},"Name":"outer","Count":"5","Text":"T:x","Custom":"custom",` +
+		`"Tree":{"At":1577934245,"Children":[{"At":1577934245}]},"Any":{"at":1577934245}}`
+	if string(data) != want {
+		t.Errorf("Expected %s, but got %s", want, data)
+	}
+
+	// Other than the formatted values, the encoding is the one of
+	// encoding/json.
+	res.Ratio = 0.5
+	data, err = json.Marshal(formatResult(reflect.ValueOf(res), &resultFormat{float: FixedDecimal(2)}))
+	if err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	want = strings.Replace(mustMarshal(t, res), `"Ratio":0.5`, `"Ratio":0.50`, 1)
+	if string(data) != want {
+		t.Errorf("Expected %s, but got %s", want, data)
+	}
+}
+
+type BadTagResponse struct {
+	Blob []byte `jsonrpc:"msgpak"`
+}
+
+type BadTagService struct{}
+
+func (s *BadTagService) Get(r *http.Request, req *struct{}, res *BadTagResponse) error {
+	return nil
+}
+
+func TestResultTagsCheckedAtRegistration(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(BadTagService), ""); err == nil || !strings.Contains(err.Error(), "msgpak") {
+		t.Errorf("Expected the unknown jsonrpc tag to be reported, but got %v", err)
+	}
+	if err := s.RegisterService(new(TimeService), ""); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+type PatchRequest struct {
+	Name  OptionalParam
+	Email OptionalParam
+	Age   *int
+}
+
+type PatchService struct {
+	last PatchRequest
+}
+
+func (s *PatchService) Patch(r *http.Request, req *PatchRequest, res *Service1Response) error {
+	s.last = *req
+	return nil
+}
+
+func TestOptionalParams(t *testing.T) {
+	service := new(PatchService)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(service, "")
+
+	for _, params := range []interface{}{
+		json.RawMessage(`{"Name": null, "Age": 3}`),
+		json.RawMessage(`[null]`),
+	} {
+		var res Service1Response
+		if err := execute(t, s, "PatchService.Patch", params, &res); err != nil {
+			t.Fatalf("Expected err to be nil for %s, but got: %v", params, err)
+		}
+		if !service.last.Name.Present || !service.last.Name.IsNull() {
+			t.Errorf("Expected Name to be explicitly null for %s, but got %+v", params, service.last.Name)
+		}
+		if service.last.Email.Present {
+			t.Errorf("Expected Email to be absent for %s, but got %+v", params, service.last.Email)
+		}
+	}
+}
+
+type IDService struct{}
+
+func (s *IDService) Echo(r *http.Request, req *struct{}, res *json.RawMessage) error {
+	*res = RequestIDFromContext(r.Context())
+	return nil
+}
+
+func TestRequestIDFromContext(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(IDService), "")
+
+	req := json.RawMessage(`{"jsonrpc": "2.0", "method": "IDService.Echo", "id": "abc-123"}`)
+	var res string
+	if err := executeRaw(t, s, req, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res != "abc-123" {
+		t.Errorf("Expected the method to read id %q, but got %q", "abc-123", res)
+	}
+}
+
+type DownloadService struct{}
+
+func (s *DownloadService) File(r *http.Request, req *struct{}, res *struct{}) error {
+	return &rpc.RawResponse{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Disposition", `attachment; filename="file.txt"`)
+		w.Write([]byte("file content"))
+	})}
+}
+
+func TestRawResponse(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(DownloadService), "")
+
+	buf, _ := EncodeClientRequest("DownloadService.File", struct{}{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if got := w.HeaderMap.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Expected Content-Type to be %q, but got %q", "text/plain", got)
+	}
+	if got := w.Body.String(); got != "file content" {
+		t.Errorf("Expected body to be %q, but got %q", "file content", got)
+	}
+}
+
+func TestResponseVersionTransformer(t *testing.T) {
+	type v1Response struct {
+		Value int `json:"value"`
+	}
+	transformer := func(version string, method string, result interface{}) interface{} {
+		if version == "1" && method == "Service1.Multiply" {
+			return &v1Response{Value: result.(*Service1Response).Result}
+		}
+		return result
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithResponseVersionTransformer(transformer)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(version string) map[string]interface{} {
+		buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-API-Version", version)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res map[string]interface{}
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Fatal("Expected err to be nil, but got:", err)
+		}
+		return res
+	}
+
+	if res := post("1"); res["value"] != float64(8) {
+		t.Errorf("Expected a v1 result, but got %v", res)
+	}
+	if res := post("2"); res["Result"] != float64(8) {
+		t.Errorf("Expected a v2 result, but got %v", res)
+	}
+}
+
+func (t *Service1) Poll(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return NotModifiedError()
+}
+
+func TestNotModifiedError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Poll", &Service1Request{4, 2}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to receive an *Error, but got %T: %s", err, err)
+	} else if jsonRpcErr.Code != -32097 {
+		t.Errorf("Expected to receive code %d, but got %d", -32097, jsonRpcErr.Code)
+	} else if jsonRpcErr.Data != nil {
+		t.Errorf("Expected no data, but got %v", jsonRpcErr.Data)
+	}
+}
+
+func TestPositionalParamsOutOfRange(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	params := json.RawMessage(`[99999999999999999999, 2]`)
+	if err := execute(t, s, "Service1.Multiply", params, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to receive an *Error, but got %T: %s", err, err)
+	} else if jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to receive an E_BAD_PARAMS error, but got %d", jsonRpcErr.Code)
+	} else if jsonRpcErr.Message != "value out of range for field A" {
+		t.Errorf("Unexpected message %q", jsonRpcErr.Message)
+	}
+}
+
+func (t *Service1) Repeat(r *http.Request, req *Service1Request, res *string) error {
+	*res = strings.Repeat("x", req.A)
+	return nil
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(
+		WithEncoderSelector(&rpc.CompressionSelector{}),
+		WithCompressionThreshold(1024),
+	), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(size int) *ResponseRecorder {
+		buf, _ := EncodeClientRequest("Service1.Repeat", &Service1Request{A: size})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post(10)
+	if got := w.HeaderMap.Get("Content-Encoding"); got != "" {
+		t.Errorf("Expected a small response not to be compressed, but got Content-Encoding %q", got)
+	}
+	var res string
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res != strings.Repeat("x", 10) {
+		t.Errorf("Unexpected response %q, err: %v", res, err)
+	}
+
+	w = post(4096)
+	if got := w.HeaderMap.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Expected a large response to be gzipped, but got Content-Encoding %q", got)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DecodeClientResponse(zr, &res); err != nil || res != strings.Repeat("x", 4096) {
+		t.Errorf("Unexpected response of length %d, err: %v", len(res), err)
+	}
+}
+
+func TestStrictRequestObject(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithStrictRequestObject(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	req := json.RawMessage(`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1}`)
+	if err := executeRaw(t, s, req, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	req = json.RawMessage(`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1, "extra": true}`)
+	if err := executeRaw(t, s, req, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_INVALID_REQ {
+		t.Errorf("Expected to receive an E_INVALID_REQ error, but got %v", err)
+	}
+}
+
+type StreamService struct{}
+
+func (s *StreamService) Count(r *http.Request, req *Service1Request, res *<-chan interface{}) error {
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+		for i := 1; i <= req.A; i++ {
+			select {
+			case ch <- i:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+	*res = ch
+	return nil
+}
+
+func TestStreamedResult(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(StreamService), "")
+
+	buf, _ := EncodeClientRequest("StreamService.Count", &Service1Request{A: 3})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if got := w.HeaderMap.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Expected Content-Type to be %q, but got %q", "application/x-ndjson", got)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, but got %d: %q", len(lines), w.Body.String())
+	}
+	for i, line := range lines {
+		var res int
+		if err := DecodeClientResponse(strings.NewReader(line), &res); err != nil {
+			t.Fatal("Expected err to be nil, but got:", err)
+		}
+		if res != i+1 {
+			t.Errorf("Expected value %d, but got %d", i+1, res)
+		}
+	}
+	if !w.Flushed {
+		t.Error("Expected the response to be flushed")
+	}
+}
+
+func TestValidateUTF8(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithValidateUTF8(true)), "application/json")
+	s.RegisterService(new(PatchService), "")
+
+	post := func(body string) error {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res Service1Response
+		return DecodeClientResponse(w.Body, &res)
+	}
+
+	if err := post(`{"jsonrpc": "2.0", "method": "PatchService.Patch", "params": {"Name": "café 😀 \ud83d\ude00"}, "id": 1}`); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	for _, params := range []string{
+		"{\"Name\": \"caf\xe9\"}",
+		`{"Name": "\udc00"}`,
+	} {
+		err := post(`{"jsonrpc": "2.0", "method": "PatchService.Patch", "params": ` + params + `, "id": 1}`)
+		if err == nil {
+			t.Errorf("Expected to receive an error for %q, but got nil", params)
+		} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+			t.Errorf("Expected to receive an E_BAD_PARAMS error for %q, but got %v", params, err)
+		}
+	}
+}
+
+type AggregateService struct{}
+
+func (s *AggregateService) Sum(r *http.Request, req *Service1Request, res *ResultWithSources) error {
+	res.Result = &Service1Response{Result: req.A + req.B}
+	res.Sources = []ResultSource{{ID: "a"}, {ID: "b", Metadata: "cached"}}
+	return nil
+}
+
+func TestResultWithSources(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(AggregateService), "")
+
+	var res struct {
+		Result  int
+		Sources []ResultSource `json:"_sources"`
+	}
+	if err := execute(t, s, "AggregateService.Sum", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 6 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+	if len(res.Sources) != 2 || res.Sources[0].ID != "a" || res.Sources[1].Metadata != "cached" {
+		t.Errorf("Unexpected sources: %+v", res.Sources)
+	}
+}
+
+func TestRejectBareNotifications(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithRejectBareNotifications(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	req := json.RawMessage(`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}}`)
+	if err := executeRaw(t, s, req, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_INVALID_REQ {
+		t.Errorf("Expected to receive an E_INVALID_REQ error, but got %v", err)
+	}
+
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+
+	// Notifications are allowed in a batch.
+	w := executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 3, "B": 2}, "id": 1}
+	]`)
+	var responses []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a batch response, but got %q: %v", w.Body, err)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("Expected 1 response, but got %d: %s", len(responses), w.Body)
+	}
+	if err := DecodeClientResponse(bytes.NewReader(responses[0]), &res); err != nil || res.Result != 6 {
+		t.Errorf("Expected result 6, but got %d, err: %v", res.Result, err)
+	}
+}
+
+func (t *Service1) DataError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return &Error{
+		Code:    E_SERVER,
+		Message: "data error",
+		Data:    map[string]interface{}{"method": "kept", "field": "A"},
+	}
+}
+
+func TestErrorContext(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithErrorContext(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(method string) map[string]interface{} {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Correlation-ID", "corr-1")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res Service1Response
+		err := DecodeClientResponse(w.Body, &res)
+		jsonRpcErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Expected to receive an *Error, but got %T: %v", err, err)
+		}
+		data, _ := jsonRpcErr.Data.(map[string]interface{})
+		return data
+	}
+
+	data := post("Service1.ResponseError")
+	if data["correlation_id"] != "corr-1" || data["method"] != "Service1.ResponseError" {
+		t.Errorf("Unexpected error data: %v", data)
+	}
+
+	data = post("Service1.DataError")
+	if data["correlation_id"] != "corr-1" || data["method"] != "kept" || data["field"] != "A" {
+		t.Errorf("Unexpected error data: %v", data)
+	}
+}
+
+func TestMethodSunset(t *testing.T) {
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := sunset.Add(-time.Hour)
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(
+		WithMethodSunset(map[string]time.Time{"Service1.Multiply": sunset}),
+		WithClock(func() time.Time { return now }),
+	), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterAlias("multiply", "Service1.Multiply")
+
+	post := func(method string) (*ResponseRecorder, error) {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res Service1Response
+		return w, DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &res)
+	}
+
+	w, err := post("Service1.Multiply")
+	if err != nil {
+		t.Error("Expected err to be nil before the sunset, but got:", err)
+	}
+	if got := w.HeaderMap.Get("Sunset"); got != "Tue, 01 Jan 2030 00:00:00 GMT" {
+		t.Errorf("Unexpected Sunset header %q", got)
+	}
+	if w.HeaderMap.Get("Warning") == "" {
+		t.Error("Expected a Warning header before the sunset")
+	}
+
+	now = sunset
+	// Aliases and other spellings of the method are removed too.
+	for _, method := range []string{"Service1.Multiply", "multiply", "Service1.multiply"} {
+		if _, err := post(method); err == nil {
+			t.Errorf("Expected to receive an error after the sunset for %s, but got nil", method)
+		} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != -32096 {
+			t.Errorf("Expected to receive a -32096 error for %s, but got %v", method, err)
+		}
+	}
+}
+
+type SignedService struct{}
+
+func (s *SignedService) Hash(r *http.Request, req *Service1Request, res *string) error {
+	sum := sha256.Sum256(RawBodyFromContext(r.Context()))
+	*res = hex.EncodeToString(sum[:])
+	return nil
+}
+
+func TestRawBodyFromContext(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(SignedService), "")
+
+	body := `{ "jsonrpc": "2.0", "method": "SignedService.Hash", "params": {"A": 1}, "id": 1 }`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res string
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	sum := sha256.Sum256([]byte(body))
+	if want := hex.EncodeToString(sum[:]); res != want {
+		t.Errorf("Expected hash %s, but got %s", want, res)
+	}
+}
+
+type ProfileResponse struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Country string `json:"country"`
+	Age     int    `json:"age"`
+}
+
+type ProfileService struct{}
+
+func (s *ProfileService) Get(r *http.Request, req *struct{}, res *ProfileResponse) error {
+	*res = ProfileResponse{1, "name", "email", "country", 42}
+	return nil
+}
+
+func TestFieldFiltering(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithFieldFiltering(true)), "application/json")
+	s.RegisterService(new(ProfileService), "")
+
+	var res map[string]interface{}
+	params := map[string]interface{}{"_fields": []string{"name", "age"}}
+	if err := execute(t, s, "ProfileService.Get", params, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if len(res) != 2 || res["name"] != "name" || res["age"] != float64(42) {
+		t.Errorf("Expected only name and age, but got %v", res)
+	}
+
+	res = nil
+	if err := execute(t, s, "ProfileService.Get", struct{}{}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if len(res) != 5 {
+		t.Errorf("Expected all the fields, but got %v", res)
+	}
+}
+
+func TestMinClientVersion(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithMinClientVersion("2.0.0", "1.10")), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(version string) *ResponseRecorder {
+		buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Client-Version", version)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if got := post("1.9.3").HeaderMap.Get("Warning"); !strings.Contains(got, "upgrade to 2.0.0") {
+		t.Errorf("Expected an upgrade warning, but got %q", got)
+	}
+	if got := post("1.10.0").HeaderMap.Get("Warning"); got != "" {
+		t.Errorf("Expected no warning, but got %q", got)
+	}
+}
+
+func (t *Service1) Unavailable(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return RetryableError(1500 * time.Millisecond)
+}
+
+func TestRetryableError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Unavailable", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if got := w.HeaderMap.Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After to be %q, but got %q", "2", got)
+	}
+
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to receive an *Error, but got %T: %v", err, err)
+	} else if jsonRpcErr.Code != E_RETRYABLE {
+		t.Errorf("Expected to receive an E_RETRYABLE error, but got %d", jsonRpcErr.Code)
+	} else if data, _ := jsonRpcErr.Data.(map[string]interface{}); data["after"] != 1.5 {
+		t.Errorf("Expected data to hold after 1.5, but got %v", jsonRpcErr.Data)
+	}
+}
+
+func (t *Service1) HTMLError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return errors.New("unexpected <tag> & more")
+}
+
+type HTMLResponse struct {
+	Msg string
+}
+
+func (t *Service1) HTMLResult(r *http.Request, req *Service1Request, res *HTMLResponse) error {
+	res.Msg = "<tag>&"
+	return nil
+}
+
+func TestErrorNotHTMLEscaped(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.HTMLError", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if !strings.Contains(w.Body.String(), `"error":{"code":-32000,"message":"unexpected <tag> & more"}`) {
+		t.Errorf("Expected an unescaped error message, but got %s", w.Body.String())
+	}
+	// Results re-encoded to filter their fields aren't escaped either.
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithFieldFiltering(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+	buf, _ = EncodeClientRequest("Service1.HTMLResult", map[string]interface{}{"_fields": []string{"Msg"}})
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"result":{"Msg":"<tag>&"}`) {
+		t.Errorf("Expected an unescaped filtered result, but got %s", w.Body.String())
+	}
+}
+
+type ScheduleRequest struct {
+	At time.Time `json:"at"`
+}
+
+type ScheduleService struct {
+	at time.Time
+}
+
+func (s *ScheduleService) Schedule(r *http.Request, req *ScheduleRequest, res *Service1Response) error {
+	s.at = req.At
+	return nil
+}
+
+type ScheduleBase struct {
+	Name string
+	Note string
+}
+
+type EmbeddedScheduleRequest struct {
+	ScheduleBase
+	At time.Time
+}
+
+func (s *ScheduleService) ScheduleNamed(r *http.Request, req *EmbeddedScheduleRequest, res *Service1Response) error {
+	s.at = req.At
+	return nil
+}
+
+func TestDefaultTimezone(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	service := new(ScheduleService)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithDefaultTimezone(loc)), "application/json")
+	s.RegisterService(service, "")
+	var intercepted []string
+	s.RegisterInterceptor(func(ctx context.Context, method string, params json.RawMessage, next rpc.Handler) (interface{}, error) {
+		intercepted = append(intercepted, string(params))
+		return next(ctx, method, params)
+	})
+
+	want := time.Date(2020, 1, 2, 3, 4, 5, 0, loc)
+	for _, params := range []interface{}{
+		map[string]string{"at": "2020-01-02T03:04:05"},
+		[]string{"2020-01-02 03:04:05"},
+	} {
+		var res Service1Response
+		if err := execute(t, s, "ScheduleService.Schedule", params, &res); err != nil {
+			t.Fatalf("Expected err to be nil for %v, but got: %v", params, err)
+		}
+		if !service.at.Equal(want) {
+			t.Errorf("Expected %v for %v, but got %v", want, params, service.at)
+		}
+	}
+
+	// Positional params follow the fields of embedded structs.
+	var res Service1Response
+	if err := execute(t, s, "ScheduleService.ScheduleNamed", []string{"name", "note", "2020-01-02 03:04:05"}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if !service.at.Equal(want) {
+		t.Errorf("Expected %v, but got %v", want, service.at)
+	}
+
+	// Interceptors get the params as sent.
+	for _, params := range intercepted {
+		if strings.Contains(params, "+02:00") {
+			t.Errorf("Expected the params as sent, but got %s", params)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	codes := ErrorCodes()
+	for _, code := range []ErrorCode{E_PARSE, E_INVALID_REQ, E_NO_METHOD, E_BAD_PARAMS, E_SERVER} {
+		if codes[int(code)] == "" {
+			t.Errorf("Expected code %d to be listed", code)
+		}
+	}
+	if got := codes[-32601]; got != "Method not found" {
+		t.Errorf("Expected message %q for -32601, but got %q", "Method not found", got)
+	}
+}
+
+func TestResultHash(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithResultHash(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(res.Result)
+	if got, want := w.HeaderMap.Get("X-Result-Hash"), hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("Expected X-Result-Hash to be %s, but got %s", want, got)
+	}
+}
+
+func (s *IDService) EchoArg(ctx context.Context, id rpc.RequestID, req *struct{}, res *json.RawMessage) error {
+	*res = json.RawMessage(id)
+	return nil
+}
+
+func TestRequestIDArgument(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(IDService), "")
+
+	req := json.RawMessage(`{"jsonrpc": "2.0", "method": "IDService.EchoArg", "id": "abc-123"}`)
+	var res string
+	if err := executeRaw(t, s, req, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res != "abc-123" {
+		t.Errorf("Expected the method to receive id %q, but got %q", "abc-123", res)
+	}
+}
+
+func TestMaxStringParamLength(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithMaxStringParamLength(5)), "application/json")
+	s.RegisterService(new(PatchService), "")
+
+	var res Service1Response
+	if err := execute(t, s, "PatchService.Patch", map[string]string{"Name": "short"}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if err := execute(t, s, "PatchService.Patch", map[string]string{"Name": "too long"}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to receive an E_BAD_PARAMS error, but got %v", err)
+	}
+}
+
+func TestLargeResultStore(t *testing.T) {
+	var stored []byte
+	store := func(ctx context.Context, method string, data []byte) (string, error) {
+		stored = data
+		return "https://storage.example.com/" + method, nil
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithLargeResultStore(100, store)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res string
+	if err := execute(t, s, "Service1.Repeat", &Service1Request{A: 10}, &res); err != nil || res != strings.Repeat("x", 10) {
+		t.Errorf("Expected a small result to be inlined, but got %q, err: %v", res, err)
+	}
+
+	var ref struct {
+		LargeResult struct {
+			URL  string `json:"url"`
+			Size int64  `json:"size"`
+		} `json:"large_result"`
+	}
+	if err := execute(t, s, "Service1.Repeat", &Service1Request{A: 1000}, &ref); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if ref.LargeResult.URL != "https://storage.example.com/Service1.Repeat" {
+		t.Errorf("Unexpected large result URL %q", ref.LargeResult.URL)
+	}
+	if ref.LargeResult.Size != int64(len(stored)) || !bytes.Contains(stored, []byte(strings.Repeat("x", 1000))) {
+		t.Errorf("Unexpected large result size %d for %d stored bytes", ref.LargeResult.Size, len(stored))
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterCodec(NewMsgpackCodec(), "application/msgpack")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, -300})
+	body, err := jsonToMsgpack(buf)
+	if err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/msgpack")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if ct := w.HeaderMap.Get("Content-Type"); ct != "application/msgpack" {
+		t.Errorf("Expected Content-Type application/msgpack, but got %q", ct)
+	}
+	data, err := msgpackToJSON(w.Body.Bytes())
+	if err != nil {
+		t.Fatal("Expected a MessagePack response, but got:", err)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(bytes.NewReader(data), &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res.Result != -1200 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("\xc1"))
+	r.Header.Set("Content-Type", "application/msgpack")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	data, err = msgpackToJSON(w.Body.Bytes())
+	if err != nil {
+		t.Fatal("Expected a MessagePack response, but got:", err)
+	}
+	if err := DecodeClientResponse(bytes.NewReader(data), &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_PARSE {
+		t.Errorf("Expected to receive an E_PARSE error, but got %v", err)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	doc := `{"a":[1,-1,-33,200,-200,70000,-70000,5000000000,18446744073709551615,1.5,"` + strings.Repeat("s", 300) + `",true,false,null],"b":{}}`
+	data, err := jsonToMsgpack([]byte(doc))
+	if err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	back, err := msgpackToJSON(data)
+	if err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if string(back) != doc {
+		t.Errorf("Expected %s, but got %s", doc, back)
+	}
+}
+
+func TestMsgpackMaxDepth(t *testing.T) {
+	data := bytes.Repeat([]byte{0x91}, 1<<20)
+	if _, err := msgpackToJSON(data); err != errMsgpackTooDeep {
+		t.Errorf("Expected %v, but got %v", errMsgpackTooDeep, err)
+	}
+	data = append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth), 0xc0)
+	if _, err := msgpackToJSON(data); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+}
+
+func TestErrorCodeRemap(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithErrorCodeRemap(map[int]int{int(E_SERVER): 32000})), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.ResponseError", &Service1Request{4, 2}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != 32000 {
+		t.Errorf("Expected to receive an error with code 32000, but got %v", err)
+	} else if jsonRpcErr.Message != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %q", ErrResponseError, jsonRpcErr.Message)
+	}
+
+	if err := executeInvalidJSON(t, s, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_PARSE {
+		t.Errorf("Expected to receive an E_PARSE error, but got %v", err)
+	}
+}
+
+func executeBatch(t *testing.T, s *rpc.Server, batch string) *ResponseRecorder {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestUnbatchableResponses(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(DownloadService), "")
+	s.RegisterService(new(StreamService), "")
+
+	w := executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "DownloadService.File", "params": {}, "id": 7},
+		{"jsonrpc": "2.0", "method": "StreamService.Count", "params": {"A": 2}, "id": 8},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 9}
+	]`)
+	var responses []struct {
+		Result *json.RawMessage `json:"result"`
+		Error  *Error           `json:"error"`
+		Id     *json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a JSON array of responses, but got %q: %v", w.Body, err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("Expected 3 responses, but got %d", len(responses))
+	}
+	for i, id := range []string{"7", "8"} {
+		res := responses[i]
+		if res.Id == nil || string(*res.Id) != id || res.Error == nil || res.Error.Code != E_INTERNAL {
+			t.Errorf("Expected an E_INTERNAL error for id %s, but got %+v", id, res)
+		}
+	}
+	if string(*responses[2].Id) != "9" || string(*responses[2].Result) != `{"Result":8}` {
+		t.Errorf("Unexpected last response: %s %s", *responses[2].Id, *responses[2].Result)
+	}
+}
+
+func TestServiceBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	w := executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 3}},
+		1,
+		[{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 4}, "id": 2}],
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 5}, "id": "3"}
+	]`)
+	var responses []struct {
+		Result *json.RawMessage `json:"result"`
+		Error  *Error           `json:"error"`
+		Id     *json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a JSON array of responses, but got %q: %v", w.Body, err)
+	}
+	if len(responses) != 4 {
+		t.Fatalf("Expected 4 responses, but got %d", len(responses))
+	}
+	if string(*responses[0].Id) != "1" || string(*responses[0].Result) != `{"Result":8}` {
+		t.Errorf("Unexpected first response: %s %s", *responses[0].Id, *responses[0].Result)
+	}
+	for _, res := range responses[1:3] {
+		if res.Error == nil || res.Error.Code != E_INVALID_REQ {
+			t.Errorf("Expected an E_INVALID_REQ error, but got %v", res.Error)
+		}
+		if res.Id != nil {
+			t.Errorf("Expected a null id, but got %s", *res.Id)
+		}
+	}
+	if string(*responses[3].Id) != `"3"` || string(*responses[3].Result) != `{"Result":20}` {
+		t.Errorf("Unexpected last response: %s %s", *responses[3].Id, *responses[3].Result)
+	}
+
+	// Only notifications.
+	w = executeBatch(t, s, `[{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}}]`)
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected an empty response, but got %q", w.Body)
+	}
+
+	// An empty batch is a single invalid request.
+	w = executeBatch(t, s, `[]`)
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_INVALID_REQ {
+		t.Errorf("Expected to receive an E_INVALID_REQ error, but got %v", err)
+	}
+
+	// An invalid batch can't be split.
+	w = executeBatch(t, s, `[{"jsonrpc": "2.0", "method": "Service1.Multiply", "id": 1},`)
+	if err := DecodeClientResponse(w.Body, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_PARSE {
+		t.Errorf("Expected to receive an E_PARSE error, but got %v", err)
+	}
+}
+
+func TestEncodeClientRequestBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	calls := []ClientCall{
+		{Method: "Service1.Multiply", Params: &Service1Request{4, 2}},
+		{Method: "Service1.Multiply", Params: &Service1Request{4, 3}, Id: json.RawMessage(`"abc-123"`)},
+		{Method: "Service1.Multiply", Params: &Service1Request{4, 4}},
+	}
+	buf, err := EncodeClientRequestBatch(calls)
+	if err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if calls[0].Id == nil || calls[2].Id == nil || string(calls[0].Id) == string(calls[2].Id) || string(calls[1].Id) != `"abc-123"` {
+		t.Errorf("Expected distinct ids, but got %s, %s, %s", calls[0].Id, calls[1].Id, calls[2].Id)
+	}
+
+	w := executeBatch(t, s, string(buf))
+	var responses []struct {
+		Result Service1Response `json:"result"`
+		Id     json.RawMessage  `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a JSON array of responses, but got %q: %v", w.Body, err)
+	}
+	results := make(map[string]int)
+	for _, res := range responses {
+		results[string(res.Id)] = res.Result.Result
+	}
+	for i, call := range calls {
+		if want := 4 * (i + 2); results[string(call.Id)] != want {
+			t.Errorf("Expected %d for id %s, but got %d", want, call.Id, results[string(call.Id)])
+		}
+	}
+
+	if _, err := EncodeClientRequestBatch([]ClientCall{{Method: "a", Id: json.RawMessage("1")}, {Method: "b", Id: json.RawMessage("1")}}); err == nil {
+		t.Error("Expected an error for duplicate ids, but got nil")
+	}
+}
+
+type Pagination struct {
+	Offset int
+	Limit  int
+}
+
+type ListRequest struct {
+	Filter string
+	Pagination
+}
+
+type ListService struct{}
+
+func (s *ListService) List(r *http.Request, req *ListRequest, res *string) error {
+	*res = fmt.Sprintf("%s %d %d", req.Filter, req.Offset, req.Limit)
+	return nil
+}
+
+func TestEmbeddedParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(ListService), "")
+
+	var res string
+	params := map[string]interface{}{"Filter": "active", "Offset": 10, "Limit": 5}
+	if err := execute(t, s, "ListService.List", params, &res); err != nil || res != "active 10 5" {
+		t.Errorf("Expected %q, but got %q, err: %v", "active 10 5", res, err)
+	}
+
+	res = ""
+	if err := execute(t, s, "ListService.List", json.RawMessage(`["active", 10, 5]`), &res); err != nil || res != "active 10 5" {
+		t.Errorf("Expected %q, but got %q, err: %v", "active 10 5", res, err)
+	}
+
+	if err := execute(t, s, "ListService.List", json.RawMessage(`["active", 10, 99999999999999999999]`), &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Message != "value out of range for field Limit" {
+		t.Errorf("Expected an out of range error for field Limit, but got %v", err)
+	}
+}
+
+func TestRequestIDRoundTrip(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, id := range []string{`"abc-123"`, `12345678901234567890`, `1.5`, `"1"`} {
+		body := `{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": ` + id + `}`
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res struct {
+			Id json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal("Expected err to be nil, but got:", err)
+		}
+		if string(res.Id) != id {
+			t.Errorf("Expected id %s, but got %s", id, res.Id)
+		}
+	}
+}
+
+func TestResponseObserver(t *testing.T) {
+	type outcome struct {
+		method string
+		code   int
+		result interface{}
+		err    *Error
+	}
+	var outcomes []outcome
+	observer := func(method string, code int, result interface{}, err *Error) {
+		outcomes = append(outcomes, outcome{method, code, result, err})
+		if err != nil {
+			err.Message = "hidden"
+		}
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithResponseObserver(observer)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if err := execute(t, s, "Service1.ResponseError", &Service1Request{4, 2}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Message != "hidden" {
+		t.Errorf("Expected the error replaced by the observer, but got %v", err)
+	}
+
+	if len(outcomes) != 2 {
+		t.Fatalf("Expected 2 outcomes, but got %d", len(outcomes))
+	}
+	if o := outcomes[0]; o.method != "Service1.Multiply" || o.code != http.StatusOK || o.err != nil {
+		t.Errorf("Unexpected success outcome %+v", o)
+	} else if reply, ok := o.result.(*Service1Response); !ok || reply.Result != 8 {
+		t.Errorf("Unexpected result %v", o.result)
+	}
+	if o := outcomes[1]; o.method != "Service1.ResponseError" || o.code != http.StatusBadRequest || o.result != nil {
+		t.Errorf("Unexpected error outcome %+v", o)
+	} else if o.err == nil || o.err.Code != E_SERVER {
+		t.Errorf("Expected an E_SERVER error, but got %v", o.err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	defer func(generator func() uint64) { IDGenerator = generator }(IDGenerator)
+	var next uint64
+	IDGenerator = func() uint64 {
+		next++
+		return next
+	}
+
+	var req clientRequest
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	if err := json.Unmarshal(buf, &req); err != nil || string(req.Id) != "1" {
+		t.Errorf("Expected id 1, but got %s, err: %v", req.Id, err)
+	}
+
+	calls := []ClientCall{{Method: "Service1.Multiply"}, {Method: "Service1.Multiply"}}
+	if _, err := EncodeClientRequestBatch(calls); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if string(calls[0].Id) != "2" || string(calls[1].Id) != "3" {
+		t.Errorf("Expected ids 2 and 3, but got %s and %s", calls[0].Id, calls[1].Id)
+	}
+
+	IDGenerator = func() uint64 { return 7 }
+	if _, err := EncodeClientRequestBatch([]ClientCall{{Method: "a"}, {Method: "b"}}); err == nil {
+		t.Error("Expected an error for duplicate generated ids, but got nil")
+	}
+}
+
+type SignupRequest struct {
+	Email    string
+	Password string
+}
+
+func (r *SignupRequest) Validate() error {
+	var errs FieldErrors
+	if !strings.Contains(r.Email, "@") {
+		errs = append(errs, FieldError{Field: "Email", Message: "must be an email address"})
+	}
+	if len(r.Password) < 8 {
+		errs = append(errs, FieldError{Field: "Password", Message: "must be at least 8 characters"})
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+type SignupService struct{}
+
+func (s *SignupService) Signup(r *http.Request, req *SignupRequest, res *bool) error {
+	*res = true
+	return nil
+}
+
+func TestFieldErrors(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithValidation(true)), "application/json")
+	s.RegisterService(new(SignupService), "")
+
+	var res bool
+	err := execute(t, s, "SignupService.Signup", &SignupRequest{Email: "nope", Password: "short"}, &res)
+	jsonRpcErr, ok := err.(*Error)
+	if !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Fatalf("Expected to receive an E_BAD_PARAMS error, but got %v", err)
+	}
+	data, _ := json.Marshal(jsonRpcErr.Data)
+	var fields FieldErrors
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal("Expected field errors in the data, but got:", string(data))
+	}
+	if len(fields) != 2 || fields[0].Field != "Email" || fields[1].Field != "Password" {
+		t.Errorf("Expected errors for Email and Password, but got %+v", fields)
+	}
+
+	if err := execute(t, s, "SignupService.Signup", &SignupRequest{Email: "a@b.c", Password: "long enough"}, &res); err != nil || !res {
+		t.Errorf("Expected a valid signup, but got %v, err: %v", res, err)
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	s := rpc.NewServer(rpc.WithGetMethods("Service1.Multiply"))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	query := url.Values{
+		"method": {"Service1.Multiply", "Service1.Multiply", "Service1.ResponseError"},
+		"params": {`{"A": 4, "B": 2}`, `[3, 3]`, `{"A": 1, "B": 1}`},
+	}
+	r, _ := http.NewRequest("GET", "http://localhost:8080/?"+query.Encode(), nil)
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var responses []struct {
+		Result *Service1Response `json:"result"`
+		Error  *Error            `json:"error"`
+		Id     int               `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a JSON array of responses, but got %q: %v", w.Body, err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("Expected 3 responses, but got %d", len(responses))
+	}
+	for i, want := range []int{8, 9} {
+		if res := responses[i]; res.Id != i || res.Result == nil || res.Result.Result != want {
+			t.Errorf("Expected result %d for id %d, but got %+v", want, i, res)
+		}
+	}
+	if res := responses[2]; res.Id != 2 || res.Error == nil || res.Error.Message != rpc.ErrGetNotAllowed.Error() {
+		t.Errorf("Expected a non-idempotent method to be rejected, but got %+v", res)
+	}
+
+	query = url.Values{
+		"method": {"Service1.Multiply", "Service1.Multiply", "Service1.Multiply", "Service1.Multiply"},
+		"params": {`1,"id":null`, `[1] x`, `7`, `{"A": 2, "B": 5}`},
+	}
+	r2, _ := http.NewRequest("GET", "http://localhost:8080/?"+query.Encode(), nil)
+	w = NewRecorder()
+	s.ServeHTTP(w, r2)
+	responses = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a JSON array of responses, but got %q: %v", w.Body, err)
+	}
+	if len(responses) != 4 {
+		t.Fatalf("Expected 4 responses, but got %d", len(responses))
+	}
+	for i, res := range responses[:3] {
+		if res.Id != i || res.Error == nil || res.Error.Code != E_INVALID_REQ {
+			t.Errorf("Expected invalid params to be rejected for id %d, but got %+v", i, res)
+		}
+	}
+	if res := responses[3]; res.Id != 3 || res.Result == nil || res.Result.Result != 10 {
+		t.Errorf("Expected result 10 for id 3, but got %+v", res)
+	}
+
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d without GET methods, but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestErrorRawData(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	err := execute(t, s, "Service1.DataError", &Service1Request{4, 2}, &res)
+	jsonRpcErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected to receive an *Error, but got %T: %s", err, err)
+	}
+	var data struct {
+		Method string `json:"method"`
+		Field  string `json:"field"`
+	}
+	if err := json.Unmarshal(jsonRpcErr.RawData(), &data); err != nil {
+		t.Fatal("Expected raw data, but got:", string(jsonRpcErr.RawData()))
+	}
+	if data.Method != "kept" || data.Field != "A" {
+		t.Errorf("Unexpected data %+v", data)
+	}
+
+	err = execute(t, s, "Service1.Poll", &Service1Request{4, 2}, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.RawData() != nil {
+		t.Errorf("Expected no raw data, but got %v", err)
+	}
+}
+
+type quotaPanic struct {
+	limit int
+}
+
+func (p quotaPanic) ToError() *Error {
+	return &Error{
+		Code:    E_SERVER - 10,
+		Message: fmt.Sprintf("quota of %d exceeded", p.limit),
+	}
+}
+
+type PanicService struct{}
+
+func (s *PanicService) Typed(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic(quotaPanic{limit: req.A})
+}
+
+func (s *PanicService) Error(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic(&Error{Code: E_BAD_PARAMS, Message: "bad A"})
+}
+
+func (s *PanicService) Untyped(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic("boom")
+}
+
+func TestTypedPanic(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(PanicService), "")
+
+	var res Service1Response
+	if err := execute(t, s, "PanicService.Typed", &Service1Request{4, 2}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_SERVER-10 || jsonRpcErr.Message != "quota of 4 exceeded" {
+		t.Errorf("Expected the error of the panic value, but got %v", err)
+	}
+	if err := execute(t, s, "PanicService.Error", &Service1Request{4, 2}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected an E_BAD_PARAMS error, but got %v", err)
+	}
+
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Errorf("Expected the untyped panic to propagate, but got %v", v)
+		}
+	}()
+	execute(t, s, "PanicService.Untyped", &Service1Request{4, 2}, &res)
+}
+
+func TestStrictParams(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCustomCodec(WithStrictParams(strict)), "application/json")
+		s.RegisterService(new(Service1), "")
+
+		var res Service1Response
+		if err := execute(t, s, "Service1.Multiply", json.RawMessage(`{"A": 4, "b": 2}`), &res); err != nil || res.Result != 8 {
+			t.Errorf("Expected named params to give 8, but got %d, err: %v", res.Result, err)
+		}
+		res = Service1Response{}
+		if err := execute(t, s, "Service1.Multiply", json.RawMessage(`[4, 3]`), &res); err != nil || res.Result != 12 {
+			t.Errorf("Expected positional params to give 12, but got %d, err: %v", res.Result, err)
+		}
+
+		res = Service1Response{}
+		err := execute(t, s, "Service1.Multiply", json.RawMessage(`{"A": 4, "B": 5, "C": 6}`), &res)
+		if !strict && (err != nil || res.Result != 20) {
+			t.Errorf("Expected an unknown member to be ignored, but got %d, err: %v", res.Result, err)
+		}
+		if strict {
+			if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS || jsonRpcErr.Message != `unknown params member "C"` {
+				t.Errorf("Expected an unknown member to be rejected, but got %v", err)
+			}
+		}
+	}
+}
+
+type UnencodableResponse struct {
+	Updates chan int
+}
+
+type UnencodableService struct{}
+
+func (s *UnencodableService) Get(r *http.Request, req *Service1Request, res *UnencodableResponse) error {
+	res.Updates = make(chan int)
+	return nil
+}
+
+func TestResultSerializationFailure(t *testing.T) {
+	var logs bytes.Buffer
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithLogger(log.New(&logs, "", 0))), "application/json")
+	s.RegisterService(new(UnencodableService), "")
+
+	buf, _ := EncodeClientRequest("UnencodableService.Get", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, w.Code)
+	}
+	var res UnencodableResponse
+	if err := DecodeClientResponse(w.Body, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_SERVER || jsonRpcErr.Message != "result serialization failed" {
+		t.Errorf("Expected a result serialization error, but got %v", err)
+	}
+	if !strings.Contains(logs.String(), "UnencodableService.Get") {
+		t.Errorf("Expected the failure to be logged, but got %q", logs.String())
+	}
+}
+
+type UploadRequest struct {
+	Name string
+	Data io.Reader
+}
+
+type UploadResponse struct {
+	Name string
+	Size int64
+}
+
+type UploadService struct{}
+
+func (s *UploadService) Upload(r *http.Request, req *UploadRequest, res *UploadResponse) error {
+	n, err := io.Copy(ioutil.Discard, req.Data)
+	res.Name, res.Size = req.Name, n
+	return err
+}
+
+func TestStreamedPayload(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithStreamedPayloads(true)), "application/json")
+	s.RegisterService(new(UploadService), "")
+	s.RegisterService(new(Service1), "")
+
+	post := func(method string, params interface{}, payload io.Reader) *ResponseRecorder {
+		envelope, _ := EncodeClientRequest(method, params)
+		body := io.MultiReader(bytes.NewReader(envelope), payload)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(EnvelopeLengthHeader, strconv.Itoa(len(envelope)))
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	const size = 8 << 20
+	w := post("UploadService.Upload", map[string]string{"Name": "blob"}, io.LimitReader(zeroReader{}, size))
+	var res UploadResponse
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res.Name != "blob" || res.Size != size {
+		t.Errorf("Expected blob of %d bytes, but got %s of %d bytes", size, res.Name, res.Size)
+	}
+
+	w = post("Service1.Multiply", &Service1Request{4, 2}, strings.NewReader("payload"))
+	if err := DecodeClientResponse(w.Body, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to receive an E_BAD_PARAMS error, but got %v", err)
+	}
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+type SleepService struct {
+	mutex   sync.Mutex
+	running int
+	max     int
+}
+
+func (s *SleepService) Sleep(r *http.Request, req *Service1Request, res *int) error {
+	s.mutex.Lock()
+	s.running++
+	if s.running > s.max {
+		s.max = s.running
+	}
+	s.mutex.Unlock()
+
+	time.Sleep(time.Duration(req.A) * time.Millisecond)
+	*res = req.A
+
+	s.mutex.Lock()
+	s.running--
+	s.mutex.Unlock()
+	return nil
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	service := new(SleepService)
+	s := rpc.NewServer(rpc.WithBatchConcurrency(3))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(service, "")
+	s.RegisterService(new(PanicService), "")
+
+	// Earlier requests complete later.
+	w := executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "SleepService.Sleep", "params": {"A": 60}, "id": 0},
+		{"jsonrpc": "2.0", "method": "SleepService.Sleep", "params": {"A": 40}, "id": 1},
+		{"jsonrpc": "2.0", "method": "PanicService.Untyped", "params": {}, "id": 2},
+		{"jsonrpc": "2.0", "method": "SleepService.Sleep", "params": {"A": 20}, "id": 3},
+		{"jsonrpc": "2.0", "method": "SleepService.Sleep", "params": {"A": 1}, "id": 4}
+	]`)
+	var responses []struct {
+		Result *int   `json:"result"`
+		Error  *Error `json:"error"`
+		Id     int    `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Expected a JSON array of responses, but got %q: %v", w.Body, err)
+	}
+	if len(responses) != 5 {
+		t.Fatalf("Expected 5 responses, but got %d", len(responses))
+	}
+	for i, want := range []int{60, 40, -1, 20, 1} {
+		res := responses[i]
+		if res.Id != i {
+			t.Errorf("Expected id %d at position %d, but got %d", i, i, res.Id)
+		}
+		if want < 0 {
+			if res.Error == nil || res.Error.Message != rpc.ErrMethodPanicked.Error() {
+				t.Errorf("Expected a panic error for id %d, but got %+v", i, res)
+			}
+		} else if res.Result == nil || *res.Result != want {
+			t.Errorf("Expected result %d for id %d, but got %+v", want, i, res)
+		}
+	}
+	if service.max < 2 || service.max > 3 {
+		t.Errorf("Expected 2 to 3 concurrent calls, but got %d", service.max)
+	}
+}
+
+type SlowService struct {
+	canceled chan error
+}
+
+func (s *SlowService) Wait(ctx context.Context, req *Service1Request, res *int) error {
+	select {
+	case <-ctx.Done():
+		s.canceled <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(time.Duration(req.A) * time.Millisecond):
+		*res = req.A
+		return nil
+	}
+}
+
+func (s *SlowService) Stubborn(ctx context.Context, req *Service1Request, res *int) error {
+	time.Sleep(time.Duration(req.A) * time.Millisecond)
+	*res = req.A
+	return nil
+}
+
+func TestMethodTimeout(t *testing.T) {
+	service := &SlowService{canceled: make(chan error, 1)}
+	s := rpc.NewServer(rpc.WithMethodTimeout(20*time.Millisecond, map[string]time.Duration{
+		"SlowService.Stubborn": 50 * time.Millisecond,
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(service, "")
+
+	var res int
+	if err := execute(t, s, "SlowService.Wait", &Service1Request{A: 1}, &res); err != nil || res != 1 {
+		t.Errorf("Expected a fast call to succeed, but got %d, err: %v", res, err)
+	}
+
+	if err := execute(t, s, "SlowService.Wait", &Service1Request{A: 1000}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_TIMEOUT {
+		t.Errorf("Expected to receive an E_TIMEOUT error, but got %v", err)
+	}
+	select {
+	case err := <-service.canceled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected the method to observe %v, but got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the context of the method to be canceled")
+	}
+
+	// A method ignoring its context is cut off, and its late reply discarded.
+	if err := execute(t, s, "SlowService.Stubborn", &Service1Request{A: 30}, &res); err != nil || res != 30 {
+		t.Errorf("Expected the per-method timeout of 50ms, but got %d, err: %v", res, err)
+	}
+	start := time.Now()
+	if err := execute(t, s, "SlowService.Stubborn", &Service1Request{A: 1000}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_TIMEOUT || jsonRpcErr.Data != nil {
+		t.Errorf("Expected to receive an E_TIMEOUT error, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the method to be cut off, but the call took %s", elapsed)
+	}
+}
+
+func TestMethodNameNormalizer(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	req := map[string]interface{}{"jsonrpc": "2.0", "method": " Service1.Multiply\n", "params": &Service1Request{4, 2}, "id": 1}
+	if err := executeRaw(t, s, req, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected the trimmed method to give 8, but got %d, err: %v", res.Result, err)
+	}
+
+	collapse := func(method string) string {
+		return strings.Replace(strings.TrimSpace(method), "..", ".", -1)
+	}
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithMethodNameNormalizer(collapse)), "application/json")
+	s.RegisterService(new(Service1), "")
+	res = Service1Response{}
+	req["method"], req["params"] = "Service1..Multiply", &Service1Request{4, 3}
+	if err := executeRaw(t, s, req, &res); err != nil || res.Result != 12 {
+		t.Errorf("Expected the collapsed method to give 12, but got %d, err: %v", res.Result, err)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	service := new(CountingService)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(service, "")
+
+	var calls []string
+	s.RegisterInterceptor(func(ctx context.Context, method string, params json.RawMessage, next rpc.Handler) (interface{}, error) {
+		calls = append(calls, "log "+method)
+		return next(ctx, method, params)
+	})
+	s.RegisterInterceptor(func(ctx context.Context, method string, params json.RawMessage, next rpc.Handler) (interface{}, error) {
+		calls = append(calls, "auth "+string(params))
+		if strings.Contains(string(params), "-1") {
+			return nil, &Error{Code: E_SERVER - 1, Message: "unauthorized"}
+		}
+		return next(ctx, method, params)
+	})
+
+	var res Service1Response
+	if err := execute(t, s, "CountingService.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, but got %d, err: %v", res.Result, err)
+	}
+	if err := execute(t, s, "CountingService.Multiply", &Service1Request{4, -1}, &res); err == nil {
+		t.Error("Expected to receive an error, but got nil")
+	} else if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Message != "unauthorized" {
+		t.Errorf("Expected the call to be rejected, but got %v", err)
+	}
+
+	want := []string{
+		"log CountingService.Multiply", `auth {"A":4,"B":2}`,
+		"log CountingService.Multiply", `auth {"A":4,"B":-1}`,
+	}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected calls %q, but got %q", want, calls)
+	}
+	if service.calls != 1 {
+		t.Errorf("Expected the method to be called once, but got %d calls", service.calls)
+	}
+}
+
+type CountingService struct {
+	calls int
+}
+
+func (s *CountingService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	s.calls++
+	res.Result = req.A * req.B
+	return nil
+}
+
+type ElapsedResponse struct {
+	Elapsed float64 `json:"_elapsed_ms"`
+}
+
+type ElapsedService struct{}
+
+func (s *ElapsedService) Get(r *http.Request, req *Service1Request, res *ElapsedResponse) error {
+	res.Elapsed = -1
+	return nil
+}
+
+func TestElapsedInResult(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	clock := func() time.Time {
+		calls++
+		return start.Add(time.Duration(calls-1) * 42 * time.Millisecond)
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithElapsedInResult(true), WithClock(clock)), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(ElapsedService), "")
+
+	var res struct {
+		Result  int
+		Elapsed float64 `json:"_elapsed_ms"`
+	}
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 || res.Elapsed != 42 {
+		t.Errorf("Expected result 8 and 42ms elapsed, but got %d and %vms", res.Result, res.Elapsed)
+	}
+
+	var elapsed ElapsedResponse
+	if err := execute(t, s, "ElapsedService.Get", &Service1Request{}, &elapsed); err != nil || elapsed.Elapsed != -1 {
+		t.Errorf("Expected the existing member to be kept, but got %v, err: %v", elapsed.Elapsed, err)
+	}
+
+	var repeated string
+	if err := execute(t, s, "Service1.Repeat", &Service1Request{A: 3}, &repeated); err != nil || repeated != "xxx" {
+		t.Errorf("Expected a non-object result to be unchanged, but got %q, err: %v", repeated, err)
+	}
+
+	buf, _ := EncodeClientRequest("Service1.HTMLResult", &Service1Request{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"Msg":"<tag>&"`) {
+		t.Errorf("Expected an unescaped result, but got %s", w.Body.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	clock := func() time.Time {
+		calls++
+		return start.Add(time.Duration(calls) * time.Millisecond)
+	}
+	var infos []CallInfo
+	var mutex sync.Mutex
+	metrics := func(info CallInfo) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		infos = append(infos, info)
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithMetrics(metrics), WithClock(clock)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("Expected 1 call to be reported, but got %d", len(infos))
+	}
+	if info := infos[0]; info.Method != "Service1.Multiply" || info.Code != 0 || info.Batch || info.Duration <= 0 {
+		t.Errorf("Unexpected call info: %+v", info)
+	}
+
+	infos = nil
+	executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1},
+		{"jsonrpc": "2.0", "method": "Service1.ResponseError", "params": {"A": 4, "B": 3}, "id": 2},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 4}}
+	]`)
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 calls to be reported, but got %d", len(infos))
+	}
+	codes := map[string][]ErrorCode{}
+	for _, info := range infos {
+		if !info.Batch {
+			t.Errorf("Expected the call to be part of a batch: %+v", info)
+		}
+		codes[info.Method] = append(codes[info.Method], info.Code)
+	}
+	if len(codes["Service1.Multiply"]) != 2 || codes["Service1.Multiply"][0] != 0 || codes["Service1.Multiply"][1] != 0 {
+		t.Errorf("Expected both calls to Service1.Multiply to succeed, but got %v", codes["Service1.Multiply"])
+	}
+	if len(codes["Service1.ResponseError"]) != 1 || codes["Service1.ResponseError"][0] != E_SERVER {
+		t.Errorf("Expected the call to Service1.ResponseError to fail with E_SERVER, but got %v", codes["Service1.ResponseError"])
+	}
+}
+
+type LoginRequest struct {
+	User     string
+	Password string `json:"password" sensitive:"true"`
+}
+
+type LoginService struct{}
+
+func (s *LoginService) Login(r *http.Request, req *LoginRequest, res *bool) error {
+	return errors.New("invalid credentials")
+}
+
+func TestEchoParamsOnError(t *testing.T) {
+	post := func(s *rpc.Server, params interface{}) *Error {
+		buf, _ := EncodeClientRequest("LoginService.Login", params)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res bool
+		err := DecodeClientResponse(w.Body, &res)
+		jsonRpcErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Expected to receive an *Error, but got %T: %v", err, err)
+		}
+		return jsonRpcErr
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithEchoParamsOnError(true)), "application/json")
+	s.RegisterService(new(LoginService), "")
+
+	data, _ := post(s, &LoginRequest{"alice", "hunter2"}).Data.(map[string]interface{})
+	params, _ := data["params"].(map[string]interface{})
+	if params["User"] != "alice" || params["password"] != "[REDACTED]" {
+		t.Errorf("Unexpected error data: %v", data)
+	}
+
+	// Positional params are redacted too.
+	data, _ = post(s, []string{"alice", "hunter2"}).Data.(map[string]interface{})
+	if positional, _ := data["params"].([]interface{}); len(positional) != 2 || positional[0] != "alice" || positional[1] != "[REDACTED]" {
+		t.Errorf("Unexpected error data: %v", data)
+	}
+
+	// Params are not echoed by default.
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(LoginService), "")
+	if err := post(s, &LoginRequest{"alice", "hunter2"}); err.Data != nil {
+		t.Errorf("Expected no error data, but got %v", err.Data)
+	}
+}
+
+func TestBOMStripping(t *testing.T) {
+	post := func(s *rpc.Server, body string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	const request = "\xef\xbb\xbf" + `{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1}`
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := DecodeClientResponse(post(s, request).Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected the BOM to be ignored, but got %v, err: %v", res.Result, err)
+	}
+	w := post(s, "\xef\xbb\xbf["+request[3:]+"]")
+	if !strings.HasPrefix(w.Body.String(), "[") || !strings.Contains(w.Body.String(), `"result":{"Result":8}`) {
+		t.Errorf("Expected the BOM to be ignored in a batch, but got %s", w.Body)
+	}
+
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithBOMStripping(false)), "application/json")
+	s.RegisterService(new(Service1), "")
+	err := DecodeClientResponse(post(s, request).Body, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_PARSE {
+		t.Errorf("Expected an E_PARSE error, but got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithCompression()), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(body []byte, encoding string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Encoding", encoding)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	gzipped := func(data string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(data))
+		zw.Close()
+		return buf.Bytes()
+	}
+	gunzipped := func(w *ResponseRecorder) io.Reader {
+		if encoding := w.HeaderMap.Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("Expected a gzipped response, but got Content-Encoding %q", encoding)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr
+	}
+
+	request, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	var res Service1Response
+	if err := DecodeClientResponse(gunzipped(post(gzipped(string(request)), "gzip")), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, err: %v", res.Result, err)
+	}
+
+	batch := `[{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": [4, 3], "id": 1}]`
+	body, _ := ioutil.ReadAll(gunzipped(post(gzipped(batch), "gzip")))
+	if !bytes.Contains(body, []byte(`"result":{"Result":12}`)) {
+		t.Errorf("Unexpected batch response: %s", body)
+	}
+
+	err := DecodeClientResponse(gunzipped(post([]byte("not gzipped"), "gzip")), &res)
+	if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_PARSE {
+		t.Errorf("Expected an E_PARSE error, but got %v", err)
+	}
+
+	// Without the option, bodies are not decompressed.
+	s = rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	err = DecodeClientResponse(post(gzipped(string(request)), "gzip").Body, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_PARSE {
+		t.Errorf("Expected an E_PARSE error, but got %v", err)
+	}
+}
+
+type WarningService struct{}
+
+func (s *WarningService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	AddWarning(r.Context(), "param A is deprecated")
+	AddWarning(r.Context(), "param B is deprecated")
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestWarnings(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(WarningService), "")
+	s.RegisterService(new(Service1), "")
+
+	post := func(method string) map[string]json.RawMessage {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Expected a JSON response, but got %q: %v", w.Body, err)
+		}
+		return res
+	}
+
+	res := post("WarningService.Multiply")
+	if string(res["result"]) != `{"Result":8}` {
+		t.Errorf("Unexpected result: %s", res["result"])
+	}
+	if string(res["warnings"]) != `["param A is deprecated","param B is deprecated"]` {
+		t.Errorf("Unexpected warnings: %s", res["warnings"])
+	}
+
+	if res = post("Service1.Multiply"); res["warnings"] != nil {
+		t.Errorf("Expected no warnings, but got %s", res["warnings"])
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	request := `{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1}`
+	batch := "[" + request + "," + request + "]"
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithMaxRequestBytes(int64(len(request)))), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := DecodeClientResponse(executeBatch(t, s, request).Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, err: %v", res.Result, err)
+	}
+	for _, body := range []string{request + " ", batch} {
+		err := DecodeClientResponse(executeBatch(t, s, body).Body, &res)
+		if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_TOO_LARGE {
+			t.Errorf("Expected an E_TOO_LARGE error, but got %v", err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	s := rpc.NewServer(rpc.WithRateLimiter(func(method string) bool {
+		return method != "Service1.Repeat"
+	}))
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var repeated string
+	err := execute(t, s, "Service1.Repeat", &Service1Request{A: 3}, &repeated)
+	if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_RATE_LIMITED {
+		t.Errorf("Expected an E_RATE_LIMITED error, but got %v", err)
+	}
+
+	w := executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "Service1.Repeat", "params": {"A": 3}, "id": 1},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 2}
+	]`)
+	var responses []struct {
+		Result *json.RawMessage `json:"result"`
+		Error  *Error           `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil || len(responses) != 2 {
+		t.Fatalf("Expected a JSON array of 2 responses, but got %q: %v", w.Body, err)
+	}
+	if responses[0].Error == nil || responses[0].Error.Code != E_RATE_LIMITED {
+		t.Errorf("Expected an E_RATE_LIMITED error, but got %v", responses[0].Error)
+	}
+	if responses[1].Result == nil || string(*responses[1].Result) != `{"Result":8}` {
+		t.Errorf("Expected the other call to proceed, but got %v", responses[1].Error)
+	}
+}
+
+func TestStrictParamsShape(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithStrictParamsShape(true)), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	post := func(method string, params string) (Service1Response, error) {
+		var res Service1Response
+		err := DecodeClientResponse(executeBatch(t, s, `{"jsonrpc": "2.0", "method": "`+method+`", "params": `+params+`, "id": 1}`).Body, &res)
+		return res, err
+	}
+
+	for _, test := range []struct{ method, params string }{
+		{"Service1.BulkInsert", `{"Name": "a", "Quantity": 1}`},
+		{"Service1.Multiply", `[{"T": "test"}]`},
+		{"Service1.Multiply", `{"A": "4"}`},
+		{"Service1.Multiply", `4`},
+	} {
+		_, err := post(test.method, test.params)
+		if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS {
+			t.Errorf("Expected an E_BAD_PARAMS error for %s params %s, but got %v", test.method, test.params, err)
+		}
+	}
+
+	for _, params := range []string{`{"A": 4, "B": 2}`, `[4, 2]`} {
+		if res, err := post("Service1.Multiply", params); err != nil || res.Result != 8 {
+			t.Errorf("Expected result 8 for params %s, but got %d, err: %v", params, res.Result, err)
+		}
+	}
+	if res, err := post("Service1.BulkInsert", `[{"Name": "a", "Quantity": 1}, {"Name": "b", "Quantity": 2}]`); err != nil || res.Result != 3 {
+		t.Errorf("Expected result 3, but got %d, err: %v", res.Result, err)
+	}
+}
+
+type FloatResponse struct {
+	Price  float64
+	Ratios []float32 `json:"ratios"`
+	Count  int
+}
+
+type FloatService struct{}
+
+func (s *FloatService) Get(r *http.Request, req *struct{}, res *FloatResponse) error {
+	*res = FloatResponse{Price: 1e6, Ratios: []float32{0.5, 2}, Count: 3}
+	return nil
+}
+
+func TestFloatFormat(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(WithFloatFormat(FixedDecimal(2))), "application/json")
+	s.RegisterService(new(FloatService), "")
+
+	buf, _ := EncodeClientRequest("FloatService.Get", struct{}{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Expected a JSON response, but got %q: %v", w.Body, err)
+	}
+	if want := `{"Price":1000000.00,"ratios":[0.50,2.00],"Count":3}`; string(res.Result) != want {
+		t.Errorf("Expected result %s, but got %s", want, res.Result)
+	}
+}
+
+type Blob struct {
+	Values []int
+	Name   string
+}
+
+type BlobResponse struct {
+	ID   int
+	Blob Blob `json:"blob" jsonrpc:"msgpack"`
+}
+
+type BlobService struct{}
+
+func (s *BlobService) Get(r *http.Request, req *struct{}, res *BlobResponse) error {
+	*res = BlobResponse{ID: 1, Blob: Blob{Values: []int{1, 2, 300}, Name: "blob"}}
+	return nil
+}
+
+func TestMsgpackField(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(BlobService), "")
+
+	var res struct {
+		ID   int
+		Blob string `json:"blob"`
+	}
+	if err := execute(t, s, "BlobService.Get", struct{}{}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	var blob Blob
+	if err := UnmarshalMsgpackField(res.Blob, &blob); err != nil {
+		t.Fatalf("Expected a MessagePack field, but got %q: %v", res.Blob, err)
+	}
+	if res.ID != 1 || blob.Name != "blob" || len(blob.Values) != 3 || blob.Values[2] != 300 {
+		t.Errorf("Unexpected result: %+v %+v", res, blob)
+	}
+}
+
+func TestPositionalParamsArity(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(PatchService), "")
+
+	for _, test := range []struct {
+		method, params, message string
+	}{
+		{"Service1.Multiply", `[4]`, `method "Service1.Multiply" takes 2 positional params, got 1`},
+		{"Service1.Multiply", `[4, 2, 1]`, `method "Service1.Multiply" takes 2 positional params, got 3`},
+		{"PatchService.Patch", `[null, null, 1, 2]`, `method "PatchService.Patch" takes 0 to 3 positional params, got 4`},
+	} {
+		var res Service1Response
+		err := execute(t, s, test.method, json.RawMessage(test.params), &res)
+		if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_BAD_PARAMS || jsonRpcErr.Message != test.message {
+			t.Errorf("Expected an E_BAD_PARAMS error %q for %s, but got %v", test.message, test.params, err)
+		}
+	}
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", json.RawMessage(`[4, 2]`), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, err: %v", res.Result, err)
+	}
+}
+
+func TestMethodNotFound(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, method := range []string{"Service1.Bogus", "Bogus.Multiply", "bogus"} {
+		var res Service1Response
+		err := executeRaw(t, s, map[string]interface{}{"jsonrpc": "2.0", "method": method, "id": 1}, &res)
+		jsonRpcErr, ok := err.(*Error)
+		if !ok || jsonRpcErr.Code != E_NO_METHOD {
+			t.Errorf("Expected an E_NO_METHOD error for %s, but got %v", method, err)
+		} else if !strings.Contains(jsonRpcErr.Message, strconv.Quote(method)) {
+			t.Errorf("Expected the message to name %s, but got %q", method, jsonRpcErr.Message)
+		}
+	}
+}
+
+func TestReadCoalesceWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	service := new(CountingService)
+	s := rpc.NewServer(
+		rpc.WithClock(func() time.Time { return now }),
+		rpc.WithReadCoalesceWindow(50*time.Millisecond, "CountingService.Multiply"),
+	)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(service, "")
+
+	call := func(a int) {
+		var res Service1Response
+		if err := execute(t, s, "CountingService.Multiply", &Service1Request{a, 2}, &res); err != nil || res.Result != a*2 {
+			t.Errorf("Expected result %d, but got %d, err: %v", a*2, res.Result, err)
+		}
+	}
+
+	// Staggered identical reads within the window share one execution.
+	for i := 0; i < 4; i++ {
+		call(4)
+		now = now.Add(20 * time.Millisecond)
+	}
+	if service.calls != 2 {
+		t.Errorf("Method was called %d times, should be 2", service.calls)
+	}
+	// Other params are executed on their own.
+	call(5)
+	if service.calls != 3 {
+		t.Errorf("Method was called %d times, should be 3", service.calls)
+	}
+}
+
+type ArrayStreamService struct{}
+
+func (s *ArrayStreamService) List(r *http.Request, req *Service1Request, res *ArrayStream) error {
+	*res = func(emit func(interface{}) error) error {
+		for i := 1; i <= req.A; i++ {
+			if err := emit(&Service1Response{Result: i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func TestArrayStream(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(ArrayStreamService), "")
+
+	buf, _ := EncodeClientRequest("ArrayStreamService.List", &Service1Request{A: 3})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("Expected a single valid JSON response, but got %q", w.Body.String())
+	}
+	var res []Service1Response
+	if err := DecodeClientResponse(bytes.NewReader(w.Body.Bytes()), &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("Expected 3 elements, but got %d: %q", len(res), w.Body.String())
+	}
+	for i, element := range res {
+		if element.Result != i+1 {
+			t.Errorf("Expected element %d to be %d, but got %d", i, i+1, element.Result)
+		}
+	}
+	if !w.Flushed {
+		t.Error("Expected the elements to be flushed as they are streamed")
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.HTTPClient = server.Client()
+
+	var res Service1Response
+	if err := client.Call(context.Background(), "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Expected res.Result to be 8, but got %d", res.Result)
+	}
+
+	// JSON-RPC errors are decoded.
+	err := client.Call(context.Background(), "Service1.ResponseError", &Service1Request{4, 2}, &res)
+	var jsonErr *Error
+	if !errors.As(err, &jsonErr) {
+		t.Fatalf("Expected an *Error, but got %#v", err)
+	}
+	if jsonErr.Code != E_SERVER || jsonErr.Message != ErrResponseError.Error() {
+		t.Errorf("Unexpected error %#v", jsonErr)
+	}
+
+	// HTTP errors are told apart.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Expected Content-Type to be %q, but got %q", "application/json", got)
+		}
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	err = NewClient(failing.URL).Call(context.Background(), "Service1.Multiply", &Service1Request{4, 2}, &res)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Expected an *HTTPError, but got %#v", err)
+	}
+	if httpErr.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(httpErr.Body), "down for maintenance") {
+		t.Errorf("Unexpected error %#v", httpErr)
+	}
+
+	// The context is honored.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.Call(ctx, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, but got %v", context.Canceled, err)
+	}
+}
+
+type ShapeService struct{}
+
+type Circle struct {
+	Radius float64
+}
+
+type Rectangle struct {
+	Width, Height float64
+}
+
+func (s *ShapeService) Area(r *http.Request, req json.RawMessage, res *float64) error {
+	var shape struct {
+		Kind string
+	}
+	if err := json.Unmarshal(req, &shape); err != nil {
+		return err
+	}
+	switch shape.Kind {
+	case "circle":
+		var circle Circle
+		if err := json.Unmarshal(req, &circle); err != nil {
+			return err
+		}
+		*res = 3 * circle.Radius * circle.Radius
+	case "rectangle":
+		var rectangle Rectangle
+		if err := json.Unmarshal(req, &rectangle); err != nil {
+			return err
+		}
+		*res = rectangle.Width * rectangle.Height
+	default:
+		return fmt.Errorf("unknown shape %q", shape.Kind)
+	}
+	return nil
+}
+
+func (s *ShapeService) Echo(r *http.Request, req *json.RawMessage, res *string) error {
+	*res = string(*req)
+	return nil
+}
+
+func TestRawParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(ShapeService), "")
+
+	var area float64
+	if err := DecodeClientResponse(executeBatch(t, s, `{"jsonrpc": "2.0", "method": "ShapeService.Area", "params": {"Kind": "circle", "Radius": 2}, "id": 1}`).Body, &area); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if area != 12 {
+		t.Errorf("Expected area 12, but got %v", area)
+	}
+	if err := DecodeClientResponse(executeBatch(t, s, `{"jsonrpc": "2.0", "method": "ShapeService.Area", "params": {"Kind": "rectangle", "Width": 2, "Height": 5}, "id": 1}`).Body, &area); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if area != 10 {
+		t.Errorf("Expected area 10, but got %v", area)
+	}
+
+	// The params are handed over untouched, whatever their shape.
+	var echo string
+	if err := DecodeClientResponse(executeBatch(t, s, `{"jsonrpc": "2.0", "method": "ShapeService.Echo", "params": [1,  "two"], "id": 1}`).Body, &echo); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if echo != `[1,  "two"]` {
+		t.Errorf("Expected raw params %q, but got %q", `[1,  "two"]`, echo)
+	}
+}
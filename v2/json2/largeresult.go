@@ -0,0 +1,29 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+)
+
+// LargeResult references a result too large to be inlined in the response,
+// that the client fetches separately from URL. It is encoded as an object
+// with a single "large_result" member.
+//
+// Methods can reply with a LargeResult directly, or have the codec store
+// large results automatically, see WithLargeResultStore.
+type LargeResult struct {
+	URL  string
+	Size int64
+}
+
+func (r LargeResult) MarshalJSON() ([]byte, error) {
+	return marshalLargeResult(r.URL, r.Size)
+}
+
+// LargeResultStore stores the encoded result of a call to method, returning
+// the URL it can be fetched from.
+type LargeResultStore func(ctx context.Context, method string, data []byte) (url string, err error)
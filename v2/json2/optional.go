@@ -0,0 +1,46 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding/json"
+)
+
+// OptionalParam is a request field telling apart a param absent from the
+// request from a param explicitly set to null. Pointer fields can't do this,
+// since encoding/json leaves them nil in both cases.
+//
+// It works with both by-name and by-position params.
+type OptionalParam struct {
+	// Present is true if the param was sent, even as null.
+	Present bool
+
+	// Raw holds the JSON value of the param.
+	Raw json.RawMessage
+}
+
+// IsNull returns true if the param was explicitly set to null.
+func (p *OptionalParam) IsNull() bool {
+	return p.Present && string(p.Raw) == "null"
+}
+
+// Decode unmarshals the param value into v.
+func (p *OptionalParam) Decode(v interface{}) error {
+	return json.Unmarshal(p.Raw, v)
+}
+
+func (p *OptionalParam) UnmarshalJSON(data []byte) error {
+	p.Present = true
+	p.Raw = append(p.Raw[:0], data...)
+	return nil
+}
+
+func (p OptionalParam) MarshalJSON() ([]byte, error) {
+	if !p.Present {
+		return []byte("null"), nil
+	}
+	return p.Raw, nil
+}
@@ -6,10 +6,22 @@
 package json2
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
 )
@@ -17,6 +29,9 @@ import (
 var null = json.RawMessage([]byte("null"))
 var Version = "2.0"
 
+// utf8BOM is the UTF-8 encoding of the byte order mark, see WithBOMStripping.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
 type JSONEncoder interface {
 	Encode(v interface{}) error
 }
@@ -57,6 +72,10 @@ type serverResponse struct {
 	// As per spec the member will be omitted if there was no error.
 	Error *Error `json:"error,omitempty"`
 
+	// The non-fatal warnings added by the invoked method with AddWarning.
+	// This is an extension member, omitted if there are none.
+	Warnings []string `json:"warnings,omitempty"`
+
 	// This must be the same id as the request it is responding to.
 	Id *json.RawMessage `json:"id"`
 }
@@ -66,10 +85,56 @@ type serverResponse struct {
 // ----------------------------------------------------------------------------
 
 type options struct {
-	encoderSelector    rpc.EncoderSelector
-	jsonEncoderFactory func(w io.Writer) JSONEncoder
-	errorMapper        func(context.Context, error) error
-	mapAllErrors       bool
+	encoderSelector         rpc.EncoderSelector
+	jsonEncoderFactory      func(w io.Writer) JSONEncoder
+	errorMapper             func(context.Context, error) error
+	mapAllErrors            bool
+	spoolThreshold          int64
+	spoolDir                string
+	servedBy                string
+	methodSchemas           map[string]methodSchema
+	strictResultSchema      bool
+	logger                  *log.Logger
+	errorHeaders            http.Header
+	timeFormat              TimeFormat
+	floatFormat             func(float64) json.RawMessage
+	versionTransformer      func(version string, method string, result interface{}) interface{}
+	compressionThreshold    int
+	strictRequestObject     bool
+	validateUTF8            bool
+	validate                bool
+	stripBOM                bool
+	decompressBodies        bool
+	maxRequestBytes         int64
+	rejectBareNotifications bool
+	errorContext            bool
+	echoParamsOnError       bool
+	methodSunsets           map[string]time.Time
+	now                     func() time.Time
+	fieldFiltering          bool
+	latestClientVersion     string
+	warnBelowClientVersion  string
+	defaultLocation         *time.Location
+	resultHash              bool
+	maxStringParamLength    int
+	largeResultThreshold    int
+	largeResultStore        LargeResultStore
+	errorCodeRemap          map[int]int
+	responseObserver        func(method string, code int, result interface{}, err *Error)
+	strictParams            bool
+	strictParamsShape       bool
+	streamedPayloads        bool
+	methodNameNormalizer    func(string) string
+	elapsedInResult         bool
+	metrics                 func(info CallInfo)
+	msgpack                 bool
+}
+
+// methodSchema holds the schemas used to validate the params and the result
+// of a method.
+type methodSchema struct {
+	params *jsonSchema
+	result *jsonSchema
 }
 
 type Option interface {
@@ -86,6 +151,18 @@ func WithEncoderSelector(encSel rpc.EncoderSelector) Option {
 	return optionFunc(func(opts *options) { opts.encoderSelector = encSel })
 }
 
+// WithCompression accepts request bodies compressed with gzip or deflate, as
+// told by their Content-Encoding header, and compresses responses with the
+// encoding negotiated by the Accept-Encoding header, see
+// rpc.CompressionSelector. A body that can't be decompressed is rejected
+// with an E_PARSE error.
+func WithCompression() Option {
+	return optionFunc(func(opts *options) {
+		opts.encoderSelector = &rpc.CompressionSelector{}
+		opts.decompressBodies = true
+	})
+}
+
 // WithErrorMapper defines an `errorMapper` function that will be called if the Service implementation
 // returns an error, with that error as a param, replacing it by the value returned by this function.
 // This function is intended to decouple your service implementation from the codec itself, making
@@ -99,6 +176,308 @@ func MapAllErrors() Option {
 	return optionFunc(func(opts *options) { opts.mapAllErrors = true })
 }
 
+// WithResultSpoolThreshold makes the codec buffer each encoded response before
+// sending it, keeping it in memory up to n bytes and moving it to a temporary
+// file beyond that. The temporary file is removed once the response has been
+// written. Array results are encoded one element at a time, so that a large
+// array doesn't have to be held in memory once encoded. Spooled responses are
+// not compressed. A zero or negative n disables spooling, which is the
+// default.
+func WithResultSpoolThreshold(n int64) Option {
+	return optionFunc(func(opts *options) { opts.spoolThreshold = n })
+}
+
+// WithServedByHeader makes the codec add an "X-Served-By" header holding the
+// hostname of the server to every response. This is mostly useful to debug
+// load-balanced deployments.
+func WithServedByHeader(enabled bool) Option {
+	return optionFunc(func(opts *options) {
+		opts.servedBy = ""
+		if enabled {
+			opts.servedBy, _ = os.Hostname()
+		}
+	})
+}
+
+// WithMethodSchema validates at runtime the params and the result of the given
+// method against JSON Schemas. Either schema can be nil to skip validating
+// that side. Only a subset of JSON Schema is supported, see jsonSchema.
+//
+// Params not matching their schema are rejected with an E_BAD_PARAMS error.
+// Results not matching their schema are logged, and replaced by an E_SERVER
+// error if StrictResultSchema is used.
+//
+// It panics if either schema can't be parsed.
+func WithMethodSchema(method string, paramsSchema, resultSchema []byte) Option {
+	params, err := parseSchema(paramsSchema)
+	if err != nil {
+		panic(fmt.Sprintf("json2: invalid params schema for method %q: %s", method, err))
+	}
+	result, err := parseSchema(resultSchema)
+	if err != nil {
+		panic(fmt.Sprintf("json2: invalid result schema for method %q: %s", method, err))
+	}
+	return optionFunc(func(opts *options) {
+		if opts.methodSchemas == nil {
+			opts.methodSchemas = make(map[string]methodSchema)
+		}
+		opts.methodSchemas[method] = methodSchema{params: params, result: result}
+	})
+}
+
+// StrictResultSchema makes results not matching the schema defined with
+// WithMethodSchema be replaced by an E_SERVER error instead of only being
+// logged.
+func StrictResultSchema() Option {
+	return optionFunc(func(opts *options) { opts.strictResultSchema = true })
+}
+
+// WithLogger sets the logger used to report problems that can't be reported
+// to the client. The standard logger is used by default.
+func WithLogger(logger *log.Logger) Option {
+	return optionFunc(func(opts *options) { opts.logger = logger })
+}
+
+// WithErrorResponseHeaders sets headers added only to error responses, e.g.
+// to prevent caching them with "Cache-Control: no-store".
+func WithErrorResponseHeaders(headers http.Header) Option {
+	return optionFunc(func(opts *options) { opts.errorHeaders = headers })
+}
+
+// WithTimeFormat sets how time.Time values found in results are encoded. The
+// default is TimeFormatRFC3339, like encoding/json.
+func WithTimeFormat(format TimeFormat) Option {
+	return optionFunc(func(opts *options) { opts.timeFormat = format })
+}
+
+// WithFloatFormat sets the function encoding the float values found in
+// results, e.g. FixedDecimal(2). It must return a valid JSON number. By
+// default, floats are encoded like encoding/json does, using an exponent for
+// large and small values.
+func WithFloatFormat(format func(float64) json.RawMessage) Option {
+	return optionFunc(func(opts *options) { opts.floatFormat = format })
+}
+
+// WithResponseVersionTransformer defines a function called with the value of
+// the "X-API-Version" request header, the method name and the result of every
+// successful call, replacing the result by the value it returns. This allows
+// to keep serving older result shapes to clients asking for an older version.
+func WithResponseVersionTransformer(fn func(version string, method string, result interface{}) interface{}) Option {
+	return optionFunc(func(opts *options) { opts.versionTransformer = fn })
+}
+
+// WithCompressionThreshold prevents the encoder selected for a request, e.g.
+// by rpc.CompressionSelector, from being used for responses smaller than n
+// bytes, which are sent as-is. Spooled responses, see
+// WithResultSpoolThreshold, are not affected.
+func WithCompressionThreshold(n int) Option {
+	return optionFunc(func(opts *options) { opts.compressionThreshold = n })
+}
+
+// WithStrictRequestObject rejects with an E_INVALID_REQ error the request
+// objects holding members other than "jsonrpc", "method", "params" and "id".
+// Unknown members are ignored by default.
+func WithStrictRequestObject(strict bool) Option {
+	return optionFunc(func(opts *options) { opts.strictRequestObject = strict })
+}
+
+// WithStrictParams rejects with an E_BAD_PARAMS error the by-name params
+// holding members that don't match a field of the args struct. The "_fields"
+// member is accepted when field filtering is enabled. Unknown members are
+// ignored by default.
+func WithStrictParams(strict bool) Option {
+	return optionFunc(func(opts *options) { opts.strictParams = strict })
+}
+
+// WithStrictParamsShape rejects with an E_BAD_PARAMS error the params that
+// don't have the shape expected by the method: an array for slice args, an
+// object for map args, and for struct args either an object or an array of
+// the field values. By default, such params go through fallback decodings,
+// e.g. an array holding the args object, and can leave the args zeroed.
+func WithStrictParamsShape(strict bool) Option {
+	return optionFunc(func(opts *options) { opts.strictParamsShape = strict })
+}
+
+// WithElapsedInResult adds to result objects an "_elapsed_ms" member holding
+// the milliseconds elapsed since the request was received. An existing member
+// of that name is kept, and results that aren't objects are left unchanged.
+func WithElapsedInResult(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.elapsedInResult = enabled })
+}
+
+// CallInfo describes a completed call, see WithMetrics.
+type CallInfo struct {
+	// Method is the name of the method called.
+	Method string
+	// Duration is the time elapsed from the request being received to its
+	// response being written.
+	Duration time.Duration
+	// Batch is true if the call was part of a batch.
+	Batch bool
+	// Code is the code of the error returned, or 0 on success.
+	Code ErrorCode
+}
+
+// WithMetrics calls fn once every call has completed, e.g. to feed a metrics
+// system. Notifications and each call of a batch are reported too.
+func WithMetrics(fn func(info CallInfo)) Option {
+	return optionFunc(func(opts *options) { opts.metrics = fn })
+}
+
+// WithMethodNameNormalizer sets the function applied to method names before
+// they are looked up, e.g. to collapse doubled separators. By default,
+// surrounding whitespace is trimmed.
+func WithMethodNameNormalizer(fn func(string) string) Option {
+	return optionFunc(func(opts *options) { opts.methodNameNormalizer = fn })
+}
+
+// EnvelopeLengthHeader is the request header holding the length of the
+// JSON-RPC request object when it is followed by a streamed payload, see
+// WithStreamedPayloads.
+const EnvelopeLengthHeader = "X-JSONRPC-Envelope-Length"
+
+// WithStreamedPayloads lets requests carry a payload streamed to the method
+// instead of being decoded from the params, e.g. for uploads. The body of such
+// a request is the request object, whose length in bytes is given by the
+// EnvelopeLengthHeader header, followed by the raw payload. The payload is
+// read from the first io.Reader field of the args struct.
+func WithStreamedPayloads(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.streamedPayloads = enabled })
+}
+
+// WithValidateUTF8 rejects with an E_BAD_PARAMS error the params holding
+// strings that are not valid UTF-8, instead of decoding the invalid sequences
+// as U+FFFD like encoding/json does.
+func WithValidateUTF8(validate bool) Option {
+	return optionFunc(func(opts *options) { opts.validateUTF8 = validate })
+}
+
+// WithValidation validates the request objects implementing Validatable on
+// every call. Otherwise they are only validated on dry runs, see
+// rpc.WithDryRunHeader.
+func WithValidation(validate bool) Option {
+	return optionFunc(func(opts *options) { opts.validate = validate })
+}
+
+// WithMaxRequestBytes rejects requests whose body, once decompressed, is
+// larger than n bytes with an E_TOO_LARGE error. The body of a batch is
+// limited as a whole. Only n bytes are ever read from the body, and the
+// payload of a streamed payload request isn't counted.
+func WithMaxRequestBytes(n int64) Option {
+	return optionFunc(func(opts *options) { opts.maxRequestBytes = n })
+}
+
+// WithBOMStripping sets whether a UTF-8 byte order mark at the start of the
+// request body is ignored, as sent by some Windows clients. It is enabled by
+// default; otherwise such requests are rejected with an E_PARSE error.
+func WithBOMStripping(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.stripBOM = enabled })
+}
+
+// WithRejectBareNotifications rejects with an E_INVALID_REQ error the
+// notifications, i.e. the requests without an id, instead of executing them
+// without responding. The error response has a null id. Notifications sent in
+// a batch are still executed.
+func WithRejectBareNotifications(reject bool) Option {
+	return optionFunc(func(opts *options) { opts.rejectBareNotifications = reject })
+}
+
+// WithErrorContext adds to the data of every error a "method" member holding
+// the method name and a "correlation_id" member holding the value of the
+// "X-Correlation-ID" request header, or the request id if the header is not
+// set. They are merged into error data that is a JSON object, without
+// replacing existing members, and are not added to other kinds of data.
+func WithErrorContext(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.errorContext = enabled })
+}
+
+// WithEchoParamsOnError adds to the data of error responses a "params" member
+// echoing the params of the request, to help debugging clients. It must not
+// be enabled in production. Members of the params decoded into struct fields
+// tagged `sensitive:"true"` are redacted. Like with WithErrorContext, it is
+// merged into error data that is a JSON object and not added to other data.
+func WithEchoParamsOnError(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.echoParamsOnError = enabled })
+}
+
+// WithMethodSunset defines the dates after which methods are removed. Calls
+// to a method after its date are rejected with an E_METHOD_REMOVED error.
+// Responses of such methods carry "Sunset" and "Warning" headers.
+func WithMethodSunset(sunsets map[string]time.Time) Option {
+	return optionFunc(func(opts *options) { opts.methodSunsets = sunsets })
+}
+
+// WithClock sets the function used by the codec to get the current time.
+// It defaults to time.Now and is mostly useful in tests.
+func WithClock(now func() time.Time) Option {
+	return optionFunc(func(opts *options) { opts.now = now })
+}
+
+// WithFieldFiltering lets clients list the result fields they need in a
+// "_fields" member of by-name params: other members of the result object are
+// then removed from the response. Results that are not objects are left as-is.
+func WithFieldFiltering(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.fieldFiltering = enabled })
+}
+
+// WithMinClientVersion adds a "Warning" header advising to upgrade to version
+// to the responses of requests whose "X-Client-Version" header holds a
+// version lower than warnBelow. Versions are compared as dot-separated
+// numbers, e.g. "1.10.0" is greater than "1.9".
+func WithMinClientVersion(version string, warnBelow string) Option {
+	return optionFunc(func(opts *options) {
+		opts.latestClientVersion = version
+		opts.warnBelowClientVersion = warnBelow
+	})
+}
+
+// WithDefaultTimezone sets the time zone of the timestamps without one that
+// are decoded into the time.Time values of the params, e.g.
+// "2006-01-02T15:04:05" or "2006-01-02". Such timestamps are rejected by
+// default.
+func WithDefaultTimezone(loc *time.Location) Option {
+	return optionFunc(func(opts *options) { opts.defaultLocation = loc })
+}
+
+// WithResultHash adds to successful responses an "X-Result-Hash" header
+// holding the hex-encoded SHA-256 hash of the encoded result, so that clients
+// can verify the result they got.
+func WithResultHash(enabled bool) Option {
+	return optionFunc(func(opts *options) { opts.resultHash = enabled })
+}
+
+// WithMaxStringParamLength rejects with an E_BAD_PARAMS error the params
+// holding a string value longer than n characters, at any depth.
+func WithMaxStringParamLength(n int) Option {
+	return optionFunc(func(opts *options) { opts.maxStringParamLength = n })
+}
+
+// WithLargeResultStore makes the codec store the results encoded in more
+// than threshold bytes using store, and reply with a LargeResult referencing
+// the stored result instead.
+func WithLargeResultStore(threshold int, store LargeResultStore) Option {
+	return optionFunc(func(opts *options) {
+		opts.largeResultThreshold = threshold
+		opts.largeResultStore = store
+	})
+}
+
+// WithErrorCodeRemap replaces the codes of error responses found in remap by
+// the associated codes, e.g. to send 601 instead of -32601 to clients that
+// don't support negative codes. It is applied last, just before the error is
+// written.
+func WithErrorCodeRemap(remap map[int]int) Option {
+	return optionFunc(func(opts *options) { opts.errorCodeRemap = remap })
+}
+
+// WithResponseObserver calls fn with the outcome of every call just before
+// its response is written, e.g. for metrics or logging: the HTTP status code
+// and either the result or the error. The error can be modified in place to
+// change the error written. Streamed results are not observed.
+func WithResponseObserver(fn func(method string, code int, result interface{}, err *Error)) Option {
+	return optionFunc(func(opts *options) { opts.responseObserver = fn })
+}
+
 func WithJSONEncoderFactory(factory func(w io.Writer) JSONEncoder) Option {
 	return optionFunc(func(opts *options) { opts.jsonEncoderFactory = factory })
 }
@@ -107,8 +486,11 @@ func WithJSONEncoderFactory(factory func(w io.Writer) JSONEncoder) Option {
 func NewCustomCodec(opts ...Option) *Codec {
 	codec := &Codec{
 		options: options{
-			encoderSelector:    rpc.DefaultEncoderSelector,
-			jsonEncoderFactory: builtInJSONEncoderFactory,
+			encoderSelector:      rpc.DefaultEncoderSelector,
+			jsonEncoderFactory:   builtInJSONEncoderFactory,
+			now:                  time.Now,
+			methodNameNormalizer: strings.TrimSpace,
+			stripBOM:             true,
 		},
 	}
 
@@ -119,8 +501,12 @@ func NewCustomCodec(opts ...Option) *Codec {
 	return codec
 }
 
+// builtInJSONEncoderFactory returns an encoding/json encoder that doesn't
+// escape HTML characters, which would garble messages holding '<', '>' or '&'.
 func builtInJSONEncoderFactory(w io.Writer) JSONEncoder {
-	return json.NewEncoder(w)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder
 }
 
 // NewCodec returns a new JSON Codec.
@@ -135,13 +521,13 @@ type Codec struct {
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
-	return newCodecRequest(
-		r,
-		c.encoderSelector.Select(r),
-		c.jsonEncoderFactory,
-		c.errorMapper,
-		c.mapAllErrors,
-	)
+	return newCodecRequest(r, c.encoderSelector.Select(r), c.options)
+}
+
+// CheckReplyType implements rpc.ReplyCheckingCodec, rejecting the replies
+// holding struct fields with a jsonrpc tag that can't be applied.
+func (c *Codec) CheckReplyType(t reflect.Type) error {
+	return checkResultTags(t, map[reflect.Type]bool{})
 }
 
 // ----------------------------------------------------------------------------
@@ -149,50 +535,126 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 // ----------------------------------------------------------------------------
 
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(
-	r *http.Request,
-	encoder rpc.Encoder,
-	jsonEncoderFactory func(w io.Writer) JSONEncoder,
-	errorMapper func(context.Context, error) error,
-	mapAllErrors bool,
-) rpc.CodecRequest {
+func newCodecRequest(r *http.Request, encoder rpc.Encoder, opts options) rpc.CodecRequest {
+	received := opts.now()
 	// Decode the request body and check if RPC method is valid.
 	req := new(serverRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
+	var raw json.RawMessage
+	var payload io.Reader
+	var err error
+	if opts.decompressBodies {
+		err = decompressBody(r)
+	}
+	envelope := io.Reader(r.Body)
+	if length := r.Header.Get(EnvelopeLengthHeader); err == nil && length != "" && opts.streamedPayloads {
+		var n int64
+		if n, err = strconv.ParseInt(length, 10, 64); err == nil && n >= 0 {
+			envelope = io.LimitReader(r.Body, n)
+			payload = r.Body
+		} else {
+			err = fmt.Errorf("invalid %s header %q", EnvelopeLengthHeader, length)
+		}
+	}
+	var body []byte
+	if err == nil {
+		body, err = readLimited(envelope, opts.maxRequestBytes)
+	}
+	if err == nil && opts.msgpack {
+		body, err = msgpackToJSON(body)
+	} else if opts.stripBOM {
+		body = bytes.TrimPrefix(body, utf8BOM)
+	}
+	if err == nil {
+		err = json.NewDecoder(bytes.NewReader(body)).Decode(&raw)
+	}
+	if err == nil && isJSONObject(raw) {
+		err = json.Unmarshal(raw, req)
+	}
+	malformed := err != nil || !isJSONObject(raw)
+	if opts.methodNameNormalizer != nil {
+		req.Method = opts.methodNameNormalizer(req.Method)
+	}
 
-	if err != nil {
+	if err == errRequestTooLarge {
+		err = &Error{
+			Code:    E_TOO_LARGE,
+			Message: fmt.Sprintf("request body larger than %d bytes", opts.maxRequestBytes),
+		}
+	} else if err != nil {
 		err = &Error{
 			Code:    E_PARSE,
 			Message: err.Error(),
 			Data:    req,
 		}
+	} else if malformed {
+		err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: "request must be a JSON object",
+		}
 	} else if req.Version != Version {
 		err = &Error{
 			Code:    E_INVALID_REQ,
 			Message: "jsonrpc must be " + Version,
 			Data:    req,
 		}
+	} else if r.Context().Value(invalidGetParamsKey{}) != nil {
+		err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: "params must be a JSON array or object",
+		}
+	} else if sunset, ok := opts.methodSunsets[req.Method]; ok && !opts.now().Before(sunset) {
+		err = &Error{
+			Code:    E_METHOD_REMOVED,
+			Message: "method removed: " + req.Method,
+		}
+	} else if opts.rejectBareNotifications && req.Id == nil && r.Context().Value(batchElementKey{}) == nil {
+		err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: "notifications are not allowed",
+			Data:    req,
+		}
+	} else if opts.strictRequestObject {
+		if member := unknownRequestMember(raw); member != "" {
+			err = &Error{
+				Code:    E_INVALID_REQ,
+				Message: "unknown request member " + strconv.Quote(member),
+				Data:    req,
+			}
+		}
 	}
 
-	r.Body.Close()
+	// The payload is still to be read by the method.
+	if payload == nil {
+		r.Body.Close()
+	}
 	return &CodecRequest{
-		request:            req,
-		err:                err,
-		encoder:            encoder,
-		jsonEncoderFactory: jsonEncoderFactory,
-		errorMapper:        errorMapper,
-		mapAllErrors:       mapAllErrors,
+		request:     req,
+		body:        body,
+		payload:     payload,
+		received:    received,
+		httpRequest: r,
+		err:         err,
+		malformed:   malformed,
+		encoder:     encoder,
+		options:     opts,
 	}
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
-	request            *serverRequest
-	err                error
-	encoder            rpc.Encoder
-	jsonEncoderFactory func(w io.Writer) JSONEncoder
-	errorMapper        func(context.Context, error) error
-	mapAllErrors       bool
+	request     *serverRequest
+	body        []byte
+	payload     io.Reader
+	received    time.Time
+	httpRequest *http.Request
+	err         error
+	malformed   bool
+	argsType    reflect.Type
+	warnings    *warningAccumulator
+	encoder     rpc.Encoder
+	// resolved is the canonical name of the method, see SetResolvedMethod.
+	resolved string
+	options
 }
 
 // Method returns the RPC method for the current request.
@@ -205,30 +667,170 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// SetResolvedMethod sets the canonical name of the method called, e.g. the
+// method an alias stands for, used to look up the options set per method.
+// An E_METHOD_REMOVED error is returned if the method is past its sunset.
+func (c *CodecRequest) SetResolvedMethod(method string) error {
+	c.resolved = method
+	if sunset, ok := c.methodSunsets[method]; ok && !c.now().Before(sunset) {
+		c.err = &Error{
+			Code:    E_METHOD_REMOVED,
+			Message: "method removed: " + c.request.Method,
+		}
+		return c.err
+	}
+	return nil
+}
+
+// resolvedMethod returns the canonical name of the method if known, or the
+// method as sent otherwise.
+func (c *CodecRequest) resolvedMethod() string {
+	if c.resolved != "" {
+		return c.resolved
+	}
+	return c.request.Method
+}
+
+// Validatable is implemented by method args that can check their own
+// validity once decoded, on dry runs or with WithValidation.
+type Validatable interface {
+	Validate() error
+}
+
 // ReadRequest fills the request object for the RPC method.
 //
 // ReadRequest parses request parameters in two supported forms in
 // accordance with http://www.jsonrpc.org/specification#parameter_structures
 //
 // by-position: params MUST be an Array, containing the
-// values in the Server expected order.
+// values in the Server expected order. An E_BAD_PARAMS error is returned if
+// their number doesn't match the fields of the request object, trailing
+// OptionalParam and pointer fields being optional.
 //
 // by-name: params MUST be an Object, with member names
 // that match the Server expected parameter names. The
 // absence of expected names MAY result in an error being
 // generated. The names MUST match exactly, including
 // case, to the method's expected parameters.
+//
+// If the request object implements Validatable, it is validated once filled,
+// on dry runs or with WithValidation only, and a validation error is returned
+// as an E_BAD_PARAMS error. The data of the
+// error lists the invalid fields of a FieldErrors validation error.
+//
+// A request object of type *json.RawMessage, e.g. for a method taking
+// json.RawMessage args, gets the raw params untouched, leaving their decoding
+// and validation to the method.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
+	c.argsType = reflect.TypeOf(args)
+	if c.err == nil && c.request.Params != nil && c.validateUTF8 && !isValidJSONUTF8(*c.request.Params) {
+		c.err = &Error{
+			Code:    E_BAD_PARAMS,
+			Message: "params contain invalid UTF-8",
+		}
+		return c.err
+	}
+	if c.err == nil && c.request.Params != nil && c.maxStringParamLength > 0 && hasLongString(*c.request.Params, c.maxStringParamLength) {
+		c.err = &Error{
+			Code:    E_BAD_PARAMS,
+			Message: fmt.Sprintf("params contain a string longer than %d characters", c.maxStringParamLength),
+		}
+		return c.err
+	}
+	if raw, ok := args.(*json.RawMessage); ok && c.err == nil {
+		// Raw params are handed over untouched.
+		if c.request.Params != nil {
+			*raw = append(json.RawMessage(nil), *c.request.Params...)
+		}
+		return nil
+	}
+	// The params decoded, which only differ from those of the request when
+	// their timestamps are localized.
+	decoded := c.request.Params
+	if c.err == nil && c.request.Params != nil && c.defaultLocation != nil {
+		params, err := localizeTimes(*c.request.Params, reflect.TypeOf(args), c.defaultLocation)
+		if err != nil {
+			c.err = &Error{
+				Code:    E_INVALID_REQ,
+				Message: err.Error(),
+				Data:    c.request.Params,
+			}
+			return c.err
+		}
+		decoded = (*json.RawMessage)(&params)
+	}
+	if c.err == nil && c.request.Params != nil && c.strictParamsShape {
+		if message := paramsShapeError(*decoded, reflect.TypeOf(args)); message != "" {
+			c.err = &Error{
+				Code:    E_BAD_PARAMS,
+				Message: message,
+				Data:    c.request.Params,
+			}
+			return c.err
+		}
+	}
 	if c.err == nil && c.request.Params != nil {
 		// Note: if c.request.Params is nil it's not an error, it's an optional member.
 		// JSON params structured object. Unmarshal to the args object.
-		if err := json.Unmarshal(*c.request.Params, args); err != nil {
+		if err := json.Unmarshal(*decoded, args); err != nil {
+			// Only struct args can be re-mapped from positional params. Other
+			// types, e.g. a slice for bulk params, are decoded as-is.
+			if !isStructPointer(args) {
+				c.err = &Error{
+					Code:    E_INVALID_REQ,
+					Message: err.Error(),
+					Data:    c.request.Params,
+				}
+				return c.err
+			}
+			if c.strictParamsShape && isJSONObject(*decoded) {
+				c.err = &Error{
+					Code:    E_BAD_PARAMS,
+					Message: err.Error(),
+					Data:    c.request.Params,
+				}
+				return c.err
+			}
+
+			// Positional params must match the fields of the struct.
+			var elems []json.RawMessage
+			if json.Unmarshal(*decoded, &elems) == nil && !isWrappedObject(elems) {
+				min, max := positionalArity(reflect.TypeOf(args).Elem())
+				if len(elems) < min || len(elems) > max {
+					message := fmt.Sprintf("method %q takes %d positional params, got %d", c.request.Method, max, len(elems))
+					if min != max {
+						message = fmt.Sprintf("method %q takes %d to %d positional params, got %d", c.request.Method, min, max, len(elems))
+					}
+					c.err = &Error{
+						Code:    E_BAD_PARAMS,
+						Message: message,
+						Data:    c.request.Params,
+					}
+					return c.err
+				}
+			}
+
 			// Clearly JSON params is not a structured object, let's try to
 			// turn the struct into a slice of its fields and parse again. This is
 			// to handle array params but re-mapped into the struct fields.
-			params := structFieldsToFieldsSlice(args)
+			if err = unmarshalFields(*decoded, args); err != nil {
+				if rangeErr, ok := err.(*fieldRangeError); ok {
+					c.err = &Error{
+						Code:    E_BAD_PARAMS,
+						Message: rangeErr.Error(),
+						Data:    c.request.Params,
+					}
+					return c.err
+				}
+				if c.strictParamsShape {
+					c.err = &Error{
+						Code:    E_BAD_PARAMS,
+						Message: err.Error(),
+						Data:    c.request.Params,
+					}
+					return c.err
+				}
 
-			if err = json.Unmarshal(*c.request.Params, &params); err != nil {
 				// Clearly JSON params is not a structured object, and
 				// reducing fields to a single array did not work.
 				// Final fallback and attempt an unmarshal with JSON params as
@@ -236,12 +838,64 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 				// array containing the request struct.
 				params := [1]interface{}{args}
 
-				if err = json.Unmarshal(*c.request.Params, &params); err != nil {
+				if err = json.Unmarshal(*decoded, &params); err != nil {
 					c.err = &Error{
 						Code:    E_INVALID_REQ,
 						Message: err.Error(),
 						Data:    c.request.Params,
 					}
+					return c.err
+				}
+			}
+		}
+	}
+	if c.err == nil && c.payload != nil && !setPayload(args, c.payload) {
+		c.err = &Error{
+			Code:    E_BAD_PARAMS,
+			Message: "method doesn't accept a streamed payload",
+		}
+		return c.err
+	}
+	if c.err == nil && c.strictParams && c.request.Params != nil && isJSONObject(*c.request.Params) && isStructPointer(args) {
+		var allowed []string
+		if c.fieldFiltering {
+			allowed = append(allowed, "_fields")
+		}
+		if member := unknownParamsMember(*c.request.Params, reflect.TypeOf(args).Elem(), allowed...); member != "" {
+			c.err = &Error{
+				Code:    E_BAD_PARAMS,
+				Message: "unknown params member " + strconv.Quote(member),
+				Data:    c.request.Params,
+			}
+			return c.err
+		}
+	}
+	if c.err == nil && (c.validate || rpc.DryRunFromContext(c.httpRequest.Context())) {
+		if v, ok := args.(Validatable); ok {
+			if err := v.Validate(); err != nil {
+				jsonErr := &Error{
+					Code:    E_BAD_PARAMS,
+					Message: err.Error(),
+				}
+				var fieldErrs FieldErrors
+				if errors.As(err, &fieldErrs) {
+					jsonErr.Data = fieldErrs
+				}
+				c.err = jsonErr
+				return c.err
+			}
+		}
+	}
+	if c.err == nil {
+		if schema := c.methodSchemas[c.resolvedMethod()].params; schema != nil {
+			var params []byte
+			if c.request.Params != nil {
+				params = *c.request.Params
+			}
+			if err := schema.validateJSON(params); err != nil {
+				c.err = &Error{
+					Code:    E_BAD_PARAMS,
+					Message: "invalid params: " + err.Error(),
 				}
 			}
 		}
@@ -249,24 +903,260 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 	return c.err
 }
 
+type requestIDKey struct{}
+
+type rawBodyKey struct{}
+
+// Context returns a copy of ctx holding the request id, the raw request body
+// and the warnings of the call, see RequestIDFromContext, RawBodyFromContext
+// and AddWarning.
+func (c *CodecRequest) Context(ctx context.Context) context.Context {
+	c.warnings = new(warningAccumulator)
+	ctx = context.WithValue(ctx, warningsKey{}, c.warnings)
+	ctx = context.WithValue(ctx, rawBodyKey{}, c.body)
+	if c.request.Id == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, *c.request.Id)
+}
+
+// Params returns the raw params of the request, or nil if it has none.
+func (c *CodecRequest) Params() json.RawMessage {
+	if c.request.Params == nil {
+		return nil
+	}
+	return *c.request.Params
+}
+
+// ID returns the raw JSON id of the request, or nil for a notification.
+func (c *CodecRequest) ID() rpc.RequestID {
+	if c.request.Id == nil {
+		return nil
+	}
+	return rpc.RequestID(*c.request.Id)
+}
+
+// RawBodyFromContext returns the request body exactly as it was received,
+// e.g. to verify a signature of the payload. It must not be modified.
+func RawBodyFromContext(ctx context.Context) []byte {
+	body, _ := ctx.Value(rawBodyKey{}).([]byte)
+	return body
+}
+
+// RequestIDFromContext returns the raw JSON id of the request being served,
+// or nil for a notification.
+func RequestIDFromContext(ctx context.Context) json.RawMessage {
+	id, _ := ctx.Value(requestIDKey{}).(json.RawMessage)
+	return id
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
+//
+// A nil reply is written as a null result.
+//
+// A reply that is a receive channel, e.g. a method reply argument of type
+// *<-chan interface{}, is streamed as newline-delimited JSON: one response
+// per value received, until the channel is closed. Methods producing the
+// values should stop when the request context is done, since nothing reads
+// the channel once the client is gone.
+//
+// A reply of type *ArrayStream is streamed as the elements of an array
+// result.
+//
+// In a batch, a receive channel reply is drained and answered with an
+// E_INTERNAL error, see rpc.ErrNotBatchable.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	if reply == nil {
+		reply = &null
+	}
+	if ch := reflect.Indirect(reflect.ValueOf(reply)); ch.Kind() == reflect.Chan && ch.Type().ChanDir()&reflect.RecvDir != 0 && !ch.IsNil() {
+		if c.inBatch() {
+			// The channel is still drained so that its producer completes.
+			for ok := true; ok; _, ok = ch.Recv() {
+			}
+			c.WriteError(c.httpRequest.Context(), w, http.StatusInternalServerError, rpc.ErrNotBatchable)
+			return
+		}
+		c.writeStream(w, ch)
+		return
+	}
+	if stream, ok := reply.(*ArrayStream); ok && *stream != nil {
+		c.writeArrayStream(w, *stream)
+		return
+	}
+	if c.versionTransformer != nil {
+		version := c.httpRequest.Header.Get("X-API-Version")
+		reply = c.versionTransformer(version, c.resolvedMethod(), reply)
+	}
+	if c.timeFormat != TimeFormatRFC3339 || c.floatFormat != nil || hasMsgpackFields(reflect.TypeOf(reply)) {
+		reply = formatResult(reflect.ValueOf(reply), &resultFormat{time: c.timeFormat, float: c.floatFormat})
+	}
+	if schema := c.methodSchemas[c.resolvedMethod()].result; schema != nil {
+		if err := c.validateResult(schema, reply); err != nil {
+			c.logf("json2: result of method %q doesn't match its schema: %s", c.request.Method, err)
+			if c.strictResultSchema {
+				c.writeServerResponse(w, &serverResponse{
+					Version: Version,
+					Error: &Error{
+						Code:    E_SERVER,
+						Message: "result doesn't match its schema",
+					},
+					Id: c.request.Id,
+				})
+				c.reportCall(E_SERVER)
+				return
+			}
+		}
+	}
+	if c.fieldFiltering {
+		if fields := c.requestedFields(); fields != nil {
+			reply = filterFields(reply, fields)
+		}
+	}
+	if c.elapsedInResult {
+		elapsed := float64(c.now().Sub(c.received)) / float64(time.Millisecond)
+		if data, err := marshalJSON(reply); err == nil && isJSONObject(data) {
+			if data, err = addObjectMember(data, "_elapsed_ms", elapsed); err == nil {
+				reply = json.RawMessage(data)
+			}
+		}
+	}
+	if c.largeResultStore != nil {
+		if ref, err := c.storeLargeResult(reply); err != nil {
+			c.logf("json2: failed to store large result of method %q: %s", c.request.Method, err)
+			c.WriteError(c.httpRequest.Context(), w, http.StatusInternalServerError, &Error{
+				Code:    E_SERVER,
+				Message: "failed to store result",
+			})
+			return
+		} else if ref != nil {
+			reply = ref
+		}
+	}
+	if c.resultHash {
+		var buf bytes.Buffer
+		if err := c.jsonEncoderFactory(&buf).Encode(reply); err == nil {
+			result := bytes.TrimRight(buf.Bytes(), "\n")
+			sum := sha256.Sum256(result)
+			w.Header().Set("X-Result-Hash", hex.EncodeToString(sum[:]))
+			reply = json.RawMessage(result)
+		}
+	}
+	if c.responseObserver != nil {
+		c.responseObserver(c.resolvedMethod(), http.StatusOK, reply, nil)
+	}
 	res := &serverResponse{
 		Version: Version,
 		Result:  reply,
 		Id:      c.request.Id,
 	}
+	if c.warnings != nil {
+		res.Warnings = c.warnings.list()
+	}
 	c.writeServerResponse(w, res)
+	c.reportCall(0)
+}
+
+// storeLargeResult stores the reply if it is larger than the large result
+// threshold, returning a reference to it, or nil if it isn't stored.
+func (c *CodecRequest) storeLargeResult(reply interface{}) (*LargeResult, error) {
+	var buf bytes.Buffer
+	if err := c.jsonEncoderFactory(&buf).Encode(reply); err != nil {
+		return nil, err
+	}
+	if buf.Len() <= c.largeResultThreshold {
+		return nil, nil
+	}
+	url, err := c.largeResultStore(c.httpRequest.Context(), c.resolvedMethod(), buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &LargeResult{URL: url, Size: int64(buf.Len())}, nil
+}
+
+// requestedFields returns the result fields listed by the "_fields" member of
+// by-name params, or nil if there is none.
+func (c *CodecRequest) requestedFields() []string {
+	if c.request.Params == nil {
+		return nil
+	}
+	var params struct {
+		Fields []string `json:"_fields"`
+	}
+	if err := json.Unmarshal(*c.request.Params, &params); err != nil {
+		return nil
+	}
+	return params.Fields
+}
+
+// writeStream writes a response per value received from ch.
+func (c *CodecRequest) writeStream(w http.ResponseWriter, ch reflect.Value) {
+	if c.request.Id != nil {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	defer c.reportCall(0)
+	flusher, _ := w.(http.Flusher)
+	encoder := c.newEncoder(w)
+	for {
+		v, ok := ch.Recv()
+		if !ok {
+			return
+		}
+		// Notifications don't get a response, but the channel is still
+		// drained so that its producer completes.
+		if c.request.Id == nil {
+			continue
+		}
+		err := encoder.Encode(&serverResponse{
+			Version: Version,
+			Result:  v.Interface(),
+			Id:      c.request.Id,
+		})
+		if err != nil {
+			c.logf("json2: failed to stream result of method %q: %s", c.request.Method, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
 }
 
 func (c *CodecRequest) WriteError(ctx context.Context, w http.ResponseWriter, status int, err error) {
 	err = c.tryToMapIfNotAnErrorAlready(ctx, err)
 	jsonErr, ok := err.(*Error)
-	if !ok {
-		jsonErr = &Error{
-			Code:    E_SERVER,
-			Message: err.Error(),
-		}
+	if !ok && errors.Is(err, rpc.ErrMethodTimeout) {
+		jsonErr = WrapError(E_TIMEOUT, err.Error(), err)
+	} else if !ok && errors.Is(err, rpc.ErrNotBatchable) {
+		jsonErr = WrapError(E_INTERNAL, err.Error(), err)
+	} else if !ok && errors.Is(err, rpc.ErrMethodNotFound) {
+		jsonErr = WrapError(E_NO_METHOD, err.Error(), err)
+	} else if !ok && errors.Is(err, rpc.ErrRateLimited) {
+		jsonErr = WrapError(E_RATE_LIMITED, err.Error(), err)
+	} else if !ok {
+		jsonErr = WrapError(E_SERVER, err.Error(), err)
+	}
+	if retry, ok := jsonErr.Data.(*RetryInfo); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.After))))
+	}
+	if c.errorContext {
+		jsonErr = c.withErrorContext(jsonErr)
+	}
+	if c.echoParamsOnError && c.request.Params != nil {
+		jsonErr = c.withParamsEcho(jsonErr)
+	}
+	for name, values := range c.errorHeaders {
+		w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	if c.responseObserver != nil {
+		observed := *jsonErr
+		c.responseObserver(c.resolvedMethod(), status, nil, &observed)
+		jsonErr = &observed
+	}
+	if code, ok := c.errorCodeRemap[int(jsonErr.Code)]; ok {
+		remapped := *jsonErr
+		remapped.Code = ErrorCode(code)
+		jsonErr = &remapped
 	}
 	res := &serverResponse{
 		Version: Version,
@@ -274,6 +1164,92 @@ func (c *CodecRequest) WriteError(ctx context.Context, w http.ResponseWriter, st
 		Id:      c.request.Id,
 	}
 	c.writeServerResponse(w, res)
+	c.reportCall(jsonErr.Code)
+}
+
+// reportCall reports the completed call to the metrics function, if any.
+func (c *CodecRequest) reportCall(code ErrorCode) {
+	if c.metrics == nil {
+		return
+	}
+	c.metrics(CallInfo{
+		Method:   c.resolvedMethod(),
+		Duration: c.now().Sub(c.received),
+		Batch:    c.inBatch(),
+		Code:     code,
+	})
+}
+
+func (c *CodecRequest) validateResult(schema *jsonSchema, reply interface{}) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return schema.validateJSON(data)
+}
+
+func (c *CodecRequest) logf(format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// withErrorContext returns a copy of err whose data holds the correlation id
+// and the method of the request, unless the data already has such members.
+func (c *CodecRequest) withErrorContext(err *Error) *Error {
+	meta := map[string]interface{}{
+		"method": c.request.Method,
+	}
+	if id := c.httpRequest.Header.Get("X-Correlation-ID"); id != "" {
+		meta["correlation_id"] = id
+	} else if c.request.Id != nil {
+		meta["correlation_id"] = c.request.Id
+	}
+
+	withContext := *err
+	if err.Data == nil {
+		withContext.Data = meta
+		return &withContext
+	}
+	data, marshalErr := marshalJSON(err.Data)
+	if marshalErr != nil || !isJSONObject(data) {
+		// Only objects can be merged with.
+		return err
+	}
+	for name, value := range meta {
+		if data, marshalErr = addObjectMember(data, name, value); marshalErr != nil {
+			return err
+		}
+	}
+	withContext.Data = json.RawMessage(data)
+	return &withContext
+}
+
+// withParamsEcho returns a copy of err whose data holds the params of the
+// request, redacted according to the args of the method if they were read.
+func (c *CodecRequest) withParamsEcho(err *Error) *Error {
+	params := *c.request.Params
+	if c.argsType != nil {
+		params = redactParams(params, c.argsType)
+	}
+
+	withEcho := *err
+	if err.Data == nil {
+		withEcho.Data = map[string]interface{}{"params": params}
+		return &withEcho
+	}
+	data, marshalErr := marshalJSON(err.Data)
+	if marshalErr != nil || !isJSONObject(data) {
+		// Only objects can be merged with.
+		return err
+	}
+	if data, marshalErr = addObjectMember(data, "params", params); marshalErr != nil {
+		return err
+	}
+	withEcho.Data = json.RawMessage(data)
+	return &withEcho
 }
 
 func (c CodecRequest) tryToMapIfNotAnErrorAlready(ctx context.Context, err error) error {
@@ -293,22 +1269,142 @@ func (c CodecRequest) tryToMapIfNotAnErrorAlready(ctx context.Context, err error
 }
 
 func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
-	// Id is null for notifications and they don't have a response, unless we couldn't even parse the JSON, in that
-	// case we can't know whether it was intended to be a notification
-	if c.request.Id != nil || isParseErrorResponse(res) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := c.jsonEncoderFactory(c.encoder.Encode(w))
-		err := encoder.Encode(res)
-
-		// Not sure in which case will this happen. But seems harmless.
+	// Id is null for notifications and they don't have a response, unless we couldn't even parse a request object, in
+	// that case we can't know whether it was intended to be a notification, or notifications are rejected
+	if c.request.Id != nil || (c.rejectBareNotifications && !c.inBatch()) || c.malformed {
+		if c.msgpack {
+			w.Header().Set("Content-Type", "application/msgpack")
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+		if c.servedBy != "" {
+			w.Header().Set("X-Served-By", c.servedBy)
+		}
+		if sunset, ok := c.methodSunsets[c.resolvedMethod()]; ok {
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			w.Header().Add("Warning", fmt.Sprintf(`299 - "method %s is deprecated and will be removed"`, c.resolvedMethod()))
+		}
+		if c.warnBelowClientVersion != "" {
+			version := c.httpRequest.Header.Get("X-Client-Version")
+			if version != "" && compareVersions(version, c.warnBelowClientVersion) < 0 {
+				w.Header().Add("Warning", fmt.Sprintf(`299 - "client version %s is outdated, please upgrade to %s"`, version, c.latestClientVersion))
+			}
+		}
+		if c.spoolThreshold > 0 {
+			c.writeSpooledResponse(w, res)
+			return
+		}
+		if c.compressionThreshold > 0 {
+			c.writeBufferedResponse(w, res)
+			return
+		}
+		encoder := c.newEncoder(c.encoder.Encode(w))
+		if err := encoder.Encode(res); err != nil {
+			c.writeEncodeError(w, res, err)
+		}
+	}
+}
+
+// writeSpooledResponse encodes the response into a spool first and only then
+// copies it to the client. An array result is encoded one element at a time,
+// so that only one of its elements has to be in memory at once; any other
+// response is encoded whole. Spooled responses are not compressed, as the
+// writers of rpc.Encoder take the response in a single write.
+func (c *CodecRequest) writeSpooledResponse(w http.ResponseWriter, res *serverResponse) {
+	spool := &spoolWriter{threshold: c.spoolThreshold, dir: c.spoolDir}
+	defer spool.Close()
+
+	var err error
+	if elements := spoolableArray(res.Result); !c.msgpack && res.Error == nil && elements.IsValid() {
+		err = c.spoolArrayResponse(spool, res, elements)
+	} else {
+		err = c.newEncoder(spool).Encode(res)
+	}
+	if err != nil {
+		c.writeEncodeError(w, res, err)
+		return
+	}
+	spool.WriteTo(w)
+}
+
+// spoolArrayResponse encodes res, whose result is the given array, into
+// spool one element at a time.
+func (c *CodecRequest) spoolArrayResponse(spool *spoolWriter, res *serverResponse, elements reflect.Value) error {
+	if err := writeString(spool, `{"jsonrpc":"`+Version+`","result":[`); err != nil {
+		return err
+	}
+	encoder := c.newEncoder(spool)
+	for i := 0; i < elements.Len(); i++ {
+		if i > 0 {
+			if err := writeString(spool, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(elements.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	if err := writeString(spool, "]"); err != nil {
+		return err
+	}
+	if res.Warnings != nil {
+		warnings, err := marshalJSON(res.Warnings)
 		if err != nil {
-			rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+			return err
+		}
+		if err := writeString(spool, `,"warnings":`+string(warnings)); err != nil {
+			return err
 		}
 	}
+	id := "null"
+	if res.Id != nil {
+		id = string(*res.Id)
+	}
+	return writeString(spool, `,"id":`+id+"}\n")
 }
 
-func isParseErrorResponse(res *serverResponse) bool {
-	return res != nil && res.Error != nil && res.Error.Code == E_PARSE
+// writeBufferedResponse encodes the response in memory first, so that the
+// encoder selected for the request is only used if the response is at least
+// compressionThreshold bytes long.
+func (c *CodecRequest) writeBufferedResponse(w http.ResponseWriter, res *serverResponse) {
+	var buf bytes.Buffer
+	encoder := c.newEncoder(&buf)
+	if err := encoder.Encode(res); err != nil {
+		c.writeEncodeError(w, res, err)
+		return
+	}
+	if buf.Len() < c.compressionThreshold {
+		w.Write(buf.Bytes())
+		return
+	}
+	c.encoder.Encode(w).Write(buf.Bytes())
+}
+
+// writeEncodeError handles a response that failed to encode. A result that
+// can't be encoded, e.g. holding a channel, is replaced by an E_SERVER error.
+func (c *CodecRequest) writeEncodeError(w http.ResponseWriter, res *serverResponse, err error) {
+	if res.Error != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.logf("json2: failed to encode result of method %q: %s", c.request.Method, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	c.writeServerResponse(w, &serverResponse{
+		Version: Version,
+		Error: &Error{
+			Code:    E_SERVER,
+			Message: "result serialization failed",
+		},
+		Id: c.request.Id,
+	})
+}
+
+// newEncoder returns the encoder used to write responses to w.
+func (c *CodecRequest) newEncoder(w io.Writer) JSONEncoder {
+	if c.msgpack {
+		return &msgpackEncoder{w}
+	}
+	return c.jsonEncoderFactory(w)
 }
 
 type EmptyResponse struct {
@@ -0,0 +1,40 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding/json"
+)
+
+// ResultSource identifies one of the sources an aggregated result was built
+// from.
+type ResultSource struct {
+	ID       string      `json:"id"`
+	Metadata interface{} `json:"metadata,omitempty"`
+}
+
+// ResultWithSources is a method reply listing the sources its result was
+// aggregated from. It is encoded as Result with an additional "_sources"
+// member holding Sources. A Result not encoded as a JSON object is put in a
+// "value" member of the encoded object.
+type ResultWithSources struct {
+	Result  interface{}
+	Sources []ResultSource
+}
+
+func (r ResultWithSources) MarshalJSON() ([]byte, error) {
+	result, err := marshalJSON(r.Result)
+	if err != nil {
+		return nil, err
+	}
+	if !isJSONObject(result) {
+		return marshalJSON(map[string]interface{}{
+			"value":    json.RawMessage(result),
+			"_sources": r.Sources,
+		})
+	}
+	return addObjectMember(result, "_sources", r.Sources)
+}
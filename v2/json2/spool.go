@@ -0,0 +1,80 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+)
+
+// spoolWriter keeps written data in memory until it grows past threshold,
+// at which point everything is moved to a temporary file.
+type spoolWriter struct {
+	threshold int64
+	dir       string
+	buf       bytes.Buffer
+	file      *os.File
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.threshold {
+		f, err := ioutil.TempFile(s.dir, "json2-spool-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// WriteTo copies the spooled data to w.
+func (s *spoolWriter) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return s.buf.WriteTo(w)
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close removes the temporary file, if any was created.
+func (s *spoolWriter) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// spoolableArray returns the slice or array held by result, if it is encoded
+// as a JSON array of its elements, or an invalid value otherwise.
+func spoolableArray(result interface{}) reflect.Value {
+	v := reflect.ValueOf(result)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		if isMarshaler(v.Type()) {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || isMarshaler(v.Type()) {
+		return reflect.Value{}
+	}
+	if v.Kind() == reflect.Slice && v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+		// Encoded as null and as base64 respectively.
+		return reflect.Value{}
+	}
+	return v
+}
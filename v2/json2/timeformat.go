@@ -0,0 +1,466 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeFormat defines how time.Time values are encoded in results.
+type TimeFormat int
+
+const (
+	// TimeFormatRFC3339 encodes times as RFC 3339 strings, like encoding/json.
+	TimeFormatRFC3339 TimeFormat = iota
+	// TimeFormatUnixMillis encodes times as milliseconds since the Unix epoch.
+	TimeFormatUnixMillis
+	// TimeFormatUnixSeconds encodes times as seconds since the Unix epoch.
+	TimeFormatUnixSeconds
+)
+
+var (
+	typeOfTime      = reflect.TypeOf(time.Time{})
+	typeOfMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func (f TimeFormat) format(t time.Time) interface{} {
+	switch f {
+	case TimeFormatUnixMillis:
+		return t.UnixNano() / int64(time.Millisecond)
+	case TimeFormatUnixSeconds:
+		return t.Unix()
+	}
+	return t
+}
+
+// resultFormat defines how the values of a result are encoded, see
+// WithTimeFormat and WithFloatFormat.
+type resultFormat struct {
+	time  TimeFormat
+	float func(float64) json.RawMessage
+}
+
+// formatResult returns a value encoding to the same JSON as v, except for
+// the time.Time and float values it holds, which are encoded using format,
+// and the struct fields tagged `jsonrpc:"msgpack"`, see UnmarshalMsgpackField.
+//
+// Values holding none of these are returned as-is. The others are walked
+// following the rules of encoding/json, structs becoming objects of their
+// encoded fields. Values implementing json.Marshaler or
+// encoding.TextMarshaler, and fields with the string option, are encoded
+// by encoding/json.
+func formatResult(v reflect.Value, format *resultFormat) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if !format.applies(t) {
+		if v.CanAddr() && t.Kind() != reflect.Ptr {
+			// Keeps the values addressable, for encoding/json to call the
+			// pointer methods of json.Marshaler.
+			return v.Addr().Interface()
+		}
+		return v.Interface()
+	}
+	if t == typeOfTime {
+		return format.time.format(v.Interface().(time.Time))
+	}
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return format.float(v.Float())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return formatResult(v.Elem(), format)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = formatResult(v.Index(i), format)
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := reflect.MakeMapWithSize(reflect.MapOf(t.Key(), typeOfInterface), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(typeOfInterface).Elem()
+			if formatted := formatResult(iter.Value(), format); formatted != nil {
+				value.Set(reflect.ValueOf(formatted))
+			}
+			out.SetMapIndex(iter.Key(), value)
+		}
+		return out.Interface()
+	case reflect.Struct:
+		obj := orderedObject{}
+		for _, field := range encodedFields(t) {
+			value, ok := fieldByIndex(v, field.index)
+			if !ok || field.omitEmpty && isEmptyValue(value) {
+				continue
+			}
+			switch {
+			case field.msgpack:
+				obj.set(field.name, msgpackValue{value})
+			case field.quoted:
+				obj.set(field.name, quotedValue{value.Interface()})
+			default:
+				obj.set(field.name, formatResult(value, format))
+			}
+		}
+		return obj
+	}
+	return v.Interface()
+}
+
+type formatKey struct {
+	typ    reflect.Type
+	times  bool
+	floats bool
+}
+
+// formatTypes caches whether types hold values changed by a format, see
+// resultFormat.applies.
+var formatTypes sync.Map
+
+var (
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfInterface     = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// applies returns true if values of type t can hold values encoded
+// differently with the format.
+func (f *resultFormat) applies(t reflect.Type) bool {
+	key := formatKey{t, f.time != TimeFormatRFC3339, f.float != nil}
+	if applies, ok := formatTypes.Load(key); ok {
+		return applies.(bool)
+	}
+	applies := key.find(t, map[reflect.Type]bool{})
+	formatTypes.Store(key, applies)
+	return applies
+}
+
+func (k formatKey) find(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == typeOfTime {
+		return k.times
+	}
+	if isMarshaler(t) || seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return k.floats
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return k.find(t.Elem(), seen)
+	case reflect.Struct:
+		for _, field := range encodedFields(t) {
+			if field.msgpack || !field.quoted && k.find(field.typ, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodedField is a struct field encoded by encoding/json.
+type encodedField struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	tagged    bool
+	omitEmpty bool
+	quoted    bool // the string option applies
+	msgpack   bool // tagged `jsonrpc:"msgpack"`
+}
+
+// encodedFieldTypes caches the encoded fields of struct types.
+var encodedFieldTypes sync.Map
+
+// encodedFields returns the fields of the struct type t that encoding/json
+// encodes, in order, the fields of embedded structs included.
+func encodedFields(t reflect.Type) []encodedField {
+	if fields, ok := encodedFieldTypes.Load(t); ok {
+		return fields.([]encodedField)
+	}
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	var candidates []encodedField
+	depths := map[string]int{}
+	visited := map[reflect.Type]bool{}
+	current := []embedded{{typ: t}}
+	for depth := 0; len(current) > 0; depth++ {
+		var next []embedded
+		for _, s := range current {
+			if visited[s.typ] {
+				continue
+			}
+			visited[s.typ] = true
+			for i := 0; i < s.typ.NumField(); i++ {
+				sf := s.typ.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+					continue
+				} else if !sf.Anonymous && sf.PkgPath != "" {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts := tag, ""
+				if idx := strings.Index(tag, ","); idx != -1 {
+					name, opts = tag[:idx], tag[idx+1:]
+				}
+				index := append(append([]int{}, s.index...), i)
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{ft, index})
+					continue
+				}
+				field := encodedField{
+					name:      name,
+					index:     index,
+					typ:       sf.Type,
+					tagged:    name != "",
+					omitEmpty: hasTagOption(opts, "omitempty"),
+					quoted:    hasTagOption(opts, "string") && isScalar(ft.Kind()),
+					msgpack:   sf.Tag.Get("jsonrpc") == "msgpack",
+				}
+				if name == "" {
+					field.name = sf.Name
+				}
+				if _, ok := depths[field.name]; !ok {
+					depths[field.name] = depth
+				}
+				if depths[field.name] == depth {
+					candidates = append(candidates, field)
+				}
+			}
+		}
+		current = next
+	}
+
+	// Of the fields sharing a name, the shallowest one is encoded if it is
+	// alone or the only tagged one at its depth.
+	var fields []encodedField
+	for _, field := range candidates {
+		var rivals, tagged int
+		for _, other := range candidates {
+			if other.name == field.name {
+				rivals++
+				if other.tagged {
+					tagged++
+				}
+			}
+		}
+		if rivals == 1 || tagged == 1 && field.tagged {
+			fields = append(fields, field)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	encodedFieldTypes.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex returns the field of v at index, or false if it is in a nil
+// embedded struct.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isMarshaler returns true if encoding/json encodes the values of type t, or
+// the addressable ones, with their own methods.
+func isMarshaler(t reflect.Type) bool {
+	if t.Implements(typeOfMarshaler) || t.Implements(typeOfTextMarshaler) {
+		return true
+	}
+	if t.Kind() != reflect.Ptr {
+		pt := reflect.PtrTo(t)
+		return pt.Implements(typeOfMarshaler) || pt.Implements(typeOfTextMarshaler)
+	}
+	return false
+}
+
+// isScalar returns true for the kinds the string option of encoding/json
+// applies to.
+func isScalar(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// quotedValue is the value of a field with the string option, encoded as a
+// string holding its JSON encoding.
+type quotedValue struct {
+	value interface{}
+}
+
+func (v quotedValue) MarshalJSON() ([]byte, error) {
+	data, err := marshalJSON(v.value)
+	if err != nil {
+		return nil, err
+	}
+	return marshalJSON(string(data))
+}
+
+// msgpackValue is the value of a field tagged `jsonrpc:"msgpack"`, encoded as
+// a base64 string of MessagePack.
+type msgpackValue struct {
+	v reflect.Value
+}
+
+func (v msgpackValue) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(v.v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if data, err = jsonToMsgpack(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(data))
+}
+
+// checkResultTags returns an error if a struct field reachable from type t
+// has a jsonrpc tag that can't be applied.
+func checkResultTags(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return checkResultTags(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag, ok := field.Tag.Lookup("jsonrpc")
+			switch {
+			case !ok:
+			case tag != "msgpack":
+				return fmt.Errorf("json2: field %s of %s has an unknown jsonrpc tag %q", field.Name, t, tag)
+			case field.PkgPath != "" || field.Tag.Get("json") == "-":
+				return fmt.Errorf("json2: field %s of %s is tagged jsonrpc:\"msgpack\" but isn't encoded", field.Name, t)
+			}
+			if err := checkResultTags(field.Type, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasTagOption(opts, option string) bool {
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyValue reports whether v is empty as defined by the omitempty option
+// of encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// orderedObject is a JSON object keeping its members in insertion order.
+type orderedObject []objectMember
+
+type objectMember struct {
+	name  string
+	value interface{}
+}
+
+// set adds a member to the object, keeping the first value set for a name
+// like encoding/json does for shadowed embedded fields.
+func (o *orderedObject) set(name string, value interface{}) {
+	for _, m := range *o {
+		if m.name == name {
+			return
+		}
+	}
+	*o = append(*o, objectMember{name, value})
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := marshalJSON(m.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := marshalJSON(m.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// zonelessLayouts are the layouts of the timestamps without time zone that
+// are interpreted in the default time zone, see WithDefaultTimezone.
+var zonelessLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// localizeTimes rewrites the zoneless timestamps of params destined to the
+// time.Time values of a t, as timestamps in the loc time zone.
+func localizeTimes(params json.RawMessage, t reflect.Type, loc *time.Location) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	// By-position params map array elements to struct fields, as
+	// unmarshalFields does.
+	if elems, ok := v.([]interface{}); ok && indirectType(t).Kind() == reflect.Struct {
+		fields, _ := structFields(reflect.New(indirectType(t)).Elem())
+		for i := range elems {
+			if i < len(fields) {
+				elems[i] = localizeValue(elems[i], fields[i].Type(), loc)
+			}
+		}
+	} else {
+		v = localizeValue(v, t, loc)
+	}
+	return json.Marshal(v)
+}
+
+func localizeValue(v interface{}, t reflect.Type, loc *time.Location) interface{} {
+	t = indirectType(t)
+	if t == typeOfTime {
+		if s, ok := v.(string); ok {
+			for _, layout := range zonelessLayouts {
+				if parsed, err := time.ParseInLocation(layout, s, loc); err == nil {
+					return parsed.Format(time.RFC3339Nano)
+				}
+			}
+		}
+		return v
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i := range v {
+				v[i] = localizeValue(v[i], t.Elem(), loc)
+			}
+		}
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Map:
+			for key, value := range v {
+				v[key] = localizeValue(value, t.Elem(), loc)
+			}
+		case reflect.Struct:
+			for key, value := range v {
+				if field, ok := fieldByJSONName(t, key); ok {
+					v[key] = localizeValue(value, field.Type, loc)
+				}
+			}
+		}
+	}
+	return v
+}
+
+// fieldByJSONName returns the field of the struct type t that encoding/json
+// decodes the object member name into.
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	var folded *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if idx := strings.Index(tag, ","); idx != -1 {
+			tag = tag[:idx]
+		}
+		if field.Anonymous && tag == "" && indirectType(field.Type).Kind() == reflect.Struct {
+			if embedded, ok := fieldByJSONName(indirectType(field.Type), name); ok {
+				return embedded, true
+			}
+			continue
+		}
+		fieldName := field.Name
+		if tag != "" {
+			fieldName = tag
+		}
+		if fieldName == name {
+			return field, true
+		}
+		if folded == nil && strings.EqualFold(fieldName, name) {
+			folded = &field
+		}
+	}
+	if folded != nil {
+		return *folded, true
+	}
+	return reflect.StructField{}, false
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
@@ -1,15 +1,497 @@
 package json2
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-func structFieldsToFieldsSlice(u interface{}) []interface{} {
-	val := reflect.ValueOf(u).Elem()
-	v := make([]interface{}, val.NumField())
+// structFields returns the fields of the struct val and their names. The
+// fields of an embedded struct take its place, as encoding/json promotes
+// them, unless it is named by a json tag. A nil embedded struct pointer is
+// allocated.
+func structFields(val reflect.Value) ([]reflect.Value, []string) {
+	var fields []reflect.Value
+	var names []string
 	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
 		valueField := val.Field(i)
-		v[i] = valueField.Addr().Interface()
+		if field.Anonymous && field.PkgPath == "" && field.Tag.Get("json") == "" {
+			if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+				if valueField.IsNil() {
+					valueField.Set(reflect.New(field.Type.Elem()))
+				}
+				valueField = valueField.Elem()
+			}
+			if valueField.Kind() == reflect.Struct {
+				embedded, embeddedNames := structFields(valueField)
+				fields = append(fields, embedded...)
+				names = append(names, embeddedNames...)
+				continue
+			}
+		}
+		fields = append(fields, valueField)
+		names = append(names, field.Name)
 	}
-	return v
+	return fields, names
+}
+
+// isStructPointer returns true if u is a pointer to a struct.
+func isStructPointer(u interface{}) bool {
+	t := reflect.TypeOf(u)
+	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct
+}
+
+// unmarshalFields unmarshals a JSON array into the fields of the struct
+// pointed to by args, one element per field. Extra elements are ignored and
+// missing ones leave their field untouched; ReadRequest checks their number
+// beforehand, see positionalArity.
+//
+// Each element is unmarshaled into its field directly, so that a null element
+// reaches the field, e.g. an OptionalParam, instead of being dropped.
+//
+// A number not fitting in its field is reported as a *fieldRangeError.
+func unmarshalFields(data []byte, args interface{}) error {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return err
+	}
+	fields, names := structFields(reflect.ValueOf(args).Elem())
+	for i, elem := range elems {
+		if i >= len(fields) {
+			break
+		}
+		if err := json.Unmarshal(elem, fields[i].Addr().Interface()); err != nil {
+			if isOutOfRange(err) {
+				return &fieldRangeError{field: names[i]}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+var typeOfOptionalParam = reflect.TypeOf(OptionalParam{})
+
+// positionalArity returns the minimum and maximum number of positional params
+// accepted by the struct type t, one per field. Trailing OptionalParam and
+// pointer fields can be left out.
+func positionalArity(t reflect.Type) (int, int) {
+	fields, _ := structFields(reflect.New(t).Elem())
+	min := len(fields)
+	for min > 0 {
+		if ft := fields[min-1].Type(); ft != typeOfOptionalParam && ft.Kind() != reflect.Ptr {
+			break
+		}
+		min--
+	}
+	return min, len(fields)
+}
+
+// isWrappedObject returns true if the array elems holds a single object,
+// taken to be the by-name params of a struct rather than its first field.
+func isWrappedObject(elems []json.RawMessage) bool {
+	return len(elems) == 1 && isJSONObject(elems[0])
+}
+
+// fieldRangeError reports a number param too large for its field.
+type fieldRangeError struct {
+	field string
+}
+
+func (e *fieldRangeError) Error() string {
+	return "value out of range for field " + e.field
+}
+
+// isOutOfRange returns true if err reports a valid JSON number that doesn't
+// fit in the Go numeric type it was unmarshaled into.
+func isOutOfRange(err error) bool {
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok || !strings.HasPrefix(typeErr.Value, "number ") {
+		return false
+	}
+	number := strings.TrimPrefix(typeErr.Value, "number ")
+	switch typeErr.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_, err = strconv.ParseInt(number, 10, typeErr.Type.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		_, err = strconv.ParseUint(number, 10, typeErr.Type.Bits())
+	case reflect.Float32, reflect.Float64:
+		_, err = strconv.ParseFloat(number, typeErr.Type.Bits())
+	default:
+		return false
+	}
+	numErr, ok := err.(*strconv.NumError)
+	return ok && numErr.Err == strconv.ErrRange
+}
+
+// unknownRequestMember returns the name of a member of the request object
+// that isn't defined by the specification, if any.
+func unknownRequestMember(raw json.RawMessage) string {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return ""
+	}
+	for name := range members {
+		switch name {
+		case "jsonrpc", "method", "params", "id":
+		default:
+			return name
+		}
+	}
+	return ""
+}
+
+var typeOfReader = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
+// setPayload sets the first exported io.Reader field of the struct pointed to
+// by args to payload. It returns false if there is no such field.
+func setPayload(args interface{}, payload io.Reader) bool {
+	if !isStructPointer(args) {
+		return false
+	}
+	val := reflect.ValueOf(args).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		if field.PkgPath == "" && field.Type == typeOfReader {
+			val.Field(i).Set(reflect.ValueOf(payload))
+			return true
+		}
+	}
+	return false
+}
+
+// unknownParamsMember returns the name of a member of the by-name params that
+// doesn't match a field of the struct type t, if any. The names in allowed
+// are accepted as well.
+func unknownParamsMember(params json.RawMessage, t reflect.Type, allowed ...string) string {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(params, &members); err != nil {
+		return ""
+	}
+	for _, name := range allowed {
+		delete(members, name)
+	}
+	for name := range members {
+		if _, ok := fieldByJSONName(t, name); !ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// errRequestTooLarge is returned by readLimited for a body over the limit.
+var errRequestTooLarge = errors.New("request too large")
+
+// readLimited reads r until EOF, failing with errRequestTooLarge once more
+// than max bytes are read. A max of 0 means no limit.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(data)) > max {
+		return data, errRequestTooLarge
+	}
+	return data, err
+}
+
+// readCloser reads from its Reader and closes its Closer, e.g. to read a
+// request body through another reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// redactedParam replaces the value of a sensitive param, see redactParams.
+var redactedParam = json.RawMessage(`"[REDACTED]"`)
+
+// redactParams returns params, decoded into the type t, with the values of
+// the struct fields tagged `sensitive:"true"` replaced, at any depth.
+// Positional params are matched with struct fields as unmarshalFields does.
+func redactParams(params json.RawMessage, t reflect.Type) json.RawMessage {
+	t = indirectType(t)
+	switch {
+	case t.Kind() == reflect.Struct && isJSONObject(params):
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(params, &members); err != nil {
+			return params
+		}
+		for name, value := range members {
+			if field, ok := fieldByJSONName(t, name); ok {
+				members[name] = redactField(value, field)
+			}
+		}
+		return marshalRedacted(params, members)
+	case t.Kind() == reflect.Struct:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(params, &elements); err != nil {
+			return params
+		}
+		_, names := structFields(reflect.New(t).Elem())
+		for i := range elements {
+			if i >= len(names) {
+				break
+			}
+			if field, ok := t.FieldByName(names[i]); ok {
+				elements[i] = redactField(elements[i], field)
+			}
+		}
+		return marshalRedacted(params, elements)
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(params, &elements); err != nil {
+			return params
+		}
+		for i := range elements {
+			elements[i] = redactParams(elements[i], t.Elem())
+		}
+		return marshalRedacted(params, elements)
+	case t.Kind() == reflect.Map:
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(params, &members); err != nil {
+			return params
+		}
+		for name, value := range members {
+			members[name] = redactParams(value, t.Elem())
+		}
+		return marshalRedacted(params, members)
+	}
+	return params
+}
+
+// redactField returns the value of field, redacted if it is sensitive.
+func redactField(value json.RawMessage, field reflect.StructField) json.RawMessage {
+	if field.Tag.Get("sensitive") == "true" {
+		return redactedParam
+	}
+	return redactParams(value, field.Type)
+}
+
+// marshalRedacted returns v encoded, or params if that fails.
+func marshalRedacted(params json.RawMessage, v interface{}) json.RawMessage {
+	data, err := marshalJSON(v)
+	if err != nil {
+		return params
+	}
+	return data
+}
+
+// isValidJSONUTF8 returns true if the JSON document data is valid UTF-8,
+// including its escaped characters: a \u escape must not be an unpaired
+// UTF-16 surrogate.
+func isValidJSONUTF8(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	inString := false
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '"':
+			inString = !inString
+		case inString && data[i] == '\\' && i+1 < len(data):
+			i++
+			if data[i] != 'u' {
+				continue
+			}
+			r, ok := parseHex4(data[i+1:])
+			if !ok {
+				continue
+			}
+			i += 4
+			if utf16.IsSurrogate(r) {
+				// A high surrogate must be followed by a low one.
+				if r >= 0xDC00 || i+2 >= len(data) || data[i+1] != '\\' || data[i+2] != 'u' {
+					return false
+				}
+				r2, ok := parseHex4(data[i+3:])
+				if !ok || r2 < 0xDC00 || r2 > 0xDFFF {
+					return false
+				}
+				i += 6
+			}
+		}
+	}
+	return true
+}
+
+// parseHex4 parses the 4 hexadecimal digits at the start of data.
+func parseHex4(data []byte) (rune, bool) {
+	if len(data) < 4 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(data[:4]), 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return rune(n), true
+}
+
+// isJSONObject returns true if data holds a JSON object.
+func isJSONObject(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+// isJSONArray returns true if data holds a JSON array.
+func isJSONArray(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '['
+}
+
+// paramsShapeError returns why params can't be decoded into the type t, or an
+// empty string if they have the expected shape: an array for a slice or an
+// array, an object for a map, and either for a struct.
+func paramsShapeError(params json.RawMessage, t reflect.Type) string {
+	switch indirectType(t).Kind() {
+	case reflect.Slice, reflect.Array:
+		if !isJSONArray(params) {
+			return "params must be an array"
+		}
+	case reflect.Map:
+		if !isJSONObject(params) {
+			return "params must be an object"
+		}
+	case reflect.Struct:
+		if !isJSONArray(params) && !isJSONObject(params) {
+			return "params must be an object or an array"
+		}
+	}
+	return ""
+}
+
+// marshalJSON is json.Marshal without the escaping of HTML characters, to
+// re-encode values the way the built-in encoder writes responses.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := builtInJSONEncoderFactory(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// addObjectMember adds a member to the JSON object obj. An existing member
+// with the same name is kept and value is ignored.
+func addObjectMember(obj []byte, name string, value interface{}) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(obj, &members); err != nil {
+		return nil, err
+	}
+	if _, ok := members[name]; ok {
+		return obj, nil
+	}
+	member, err := marshalJSON(map[string]interface{}{name: value})
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return member, nil
+	}
+	// Splice the new member in front of the existing ones.
+	obj = bytes.TrimLeft(obj, " \t\r\n")
+	out := make([]byte, 0, len(member)+len(obj))
+	out = append(out, member[:len(member)-1]...)
+	out = append(out, ',')
+	return append(out, obj[1:]...), nil
+}
+
+// filterFields returns the members of the result object named in fields, in
+// that order. The result is returned unchanged if it isn't an object.
+func filterFields(result interface{}, fields []string) interface{} {
+	data, err := marshalJSON(result)
+	if err != nil || !isJSONObject(data) {
+		return result
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return result
+	}
+	filtered := orderedObject{}
+	for _, name := range fields {
+		if value, ok := members[name]; ok {
+			filtered.set(name, value)
+		}
+	}
+	return filtered
+}
+
+// compareVersions compares two dot-separated versions such as "v1.2.3",
+// returning -1, 0 or 1. A leading "v" and any "-" or "+" suffix are ignored,
+// as well as the parts that are not numbers.
+func compareVersions(a, b string) int {
+	as, bs := versionParts(a), versionParts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if idx := strings.IndexAny(version, "-+"); idx != -1 {
+		version = version[:idx]
+	}
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, _ := strconv.Atoi(part)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// hasLongString returns true if the JSON document data holds a string value
+// longer than max characters.
+func hasLongString(data []byte, max int) bool {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return false
+	}
+	return isLongString(v, max)
+}
+
+func isLongString(v interface{}, max int) bool {
+	switch v := v.(type) {
+	case string:
+		return utf8.RuneCountInString(v) > max
+	case []interface{}:
+		for _, elem := range v {
+			if isLongString(elem, max) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, value := range v {
+			if isLongString(value, max) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func marshalLargeResult(url string, size int64) ([]byte, error) {
+	type reference struct {
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+	}
+	return marshalJSON(map[string]reference{"large_result": {url, size}})
 }
@@ -0,0 +1,42 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"context"
+	"sync"
+)
+
+type warningsKey struct{}
+
+// warningAccumulator collects the warnings added during a call.
+type warningAccumulator struct {
+	mutex    sync.Mutex
+	warnings []string
+}
+
+func (a *warningAccumulator) add(warning string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.warnings = append(a.warnings, warning)
+}
+
+func (a *warningAccumulator) list() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string(nil), a.warnings...)
+}
+
+// AddWarning adds a non-fatal warning to the call served with ctx, e.g. the
+// use of a deprecated param. The warnings of a successful call are sent in
+// the "warnings" member of its response, next to its result.
+//
+// AddWarning does nothing if ctx isn't the context of a JSON-RPC call.
+func AddWarning(ctx context.Context, warning string) {
+	if a, ok := ctx.Value(warningsKey{}).(*warningAccumulator); ok {
+		a.add(warning)
+	}
+}
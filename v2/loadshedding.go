@@ -0,0 +1,55 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrServerBusy is the error of a call rejected to shed load, see
+// WithLoadShedding.
+var ErrServerBusy = errors.New("rpc: server busy, retry later")
+
+// loadShedder rejects a fraction of the non-critical calls.
+type loadShedder struct {
+	healthFn func() float64
+	critical map[string]bool
+	mutex    sync.Mutex
+	credit   float64
+}
+
+func newLoadShedder(healthFn func() float64, criticalMethods []string) *loadShedder {
+	critical := make(map[string]bool, len(criticalMethods))
+	for _, method := range criticalMethods {
+		critical[method] = true
+	}
+	return &loadShedder{healthFn: healthFn, critical: critical}
+}
+
+// shed returns true if the call to method must be rejected. Calls are shed
+// evenly, so that exactly the requested fraction of them is rejected.
+func (l *loadShedder) shed(method string) bool {
+	if l.critical[method] {
+		return false
+	}
+	fraction := l.healthFn()
+	if fraction <= 0 {
+		return false
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.credit += fraction
+	if l.credit >= 1 {
+		l.credit--
+		return true
+	}
+	return false
+}
@@ -6,9 +6,13 @@
 package rpc
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"unicode"
@@ -16,9 +20,13 @@ import (
 )
 
 var (
-	// Precompute the reflect.Type of error and http.Request
-	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
-	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	// Precompute the reflect.Type of error, http.Request, context.Context,
+	// RequestID and json.RawMessage
+	typeOfError      = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfRequest    = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfContext    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfRequestID  = reflect.TypeOf(RequestID(nil))
+	typeOfRawMessage = reflect.TypeOf(json.RawMessage(nil))
 )
 
 // ----------------------------------------------------------------------------
@@ -33,9 +41,12 @@ type service struct {
 }
 
 type serviceMethod struct {
-	method    reflect.Method // receiver method
-	argsType  reflect.Type   // type of the request argument
-	replyType reflect.Type   // type of the response argument
+	method      reflect.Method // receiver method
+	argsType    reflect.Type   // type of the request argument
+	replyType   reflect.Type   // type of the response argument
+	withContext bool           // receives context.Context instead of *http.Request
+	withID      bool           // receives context.Context and RequestID
+	argsByValue bool           // receives the request argument by value
 }
 
 // ----------------------------------------------------------------------------
@@ -46,10 +57,117 @@ type serviceMethod struct {
 type serviceMap struct {
 	mutex    sync.Mutex
 	services map[string]*service
+	disabled map[string]*service
+	aliases  map[string]string
+	// separators are the separators of service and method names, or
+	// MethodSeparator if empty.
+	separators []string
 }
 
 // register adds a new service using reflection to extract its methods.
 func (m *serviceMap) register(rcvr interface{}, name string) error {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	// Add to the map.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.services == nil {
+		m.services = make(map[string]*service)
+	} else if _, ok := m.services[s.name]; ok {
+		return fmt.Errorf("rpc: service already defined: %q", s.name)
+	}
+	m.services[s.name] = s
+	return nil
+}
+
+// replyTypes returns the reply types of the methods of the service that
+// register would add, by method name.
+func (m *serviceMap) replyTypes(rcvr interface{}, name string) (map[string]reflect.Type, error) {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]reflect.Type, len(s.methods))
+	for _, method := range s.methods {
+		types[m.name(s, method)] = method.replyType
+	}
+	return types, nil
+}
+
+// methodNames returns the names of the methods of the service that register
+// would add, as in "Service.Method".
+func (m *serviceMap) methodNames(rcvr interface{}, name string) ([]string, error) {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(s.methods))
+	for _, method := range s.methods {
+		names = append(names, m.name(s, method))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// name returns the canonical name of a method of the service, as in
+// "Service.Method" with the first separator, whatever the spelling used to
+// call it.
+func (m *serviceMap) name(s *service, method *serviceMethod) string {
+	separator := MethodSeparator
+	if len(m.separators) != 0 {
+		separator = m.separators[0]
+	}
+	return s.name + separator + method.method.Name
+}
+
+// disable records a service that is intentionally not registered.
+func (m *serviceMap) disable(rcvr interface{}, name string) error {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.disabled == nil {
+		m.disabled = make(map[string]*service)
+	}
+	m.disabled[s.name] = s
+	return nil
+}
+
+// isDisabled returns true if the method belongs to a disabled service.
+//
+// The method name uses a dotted notation as in "Service.Method".
+func (m *serviceMap) isDisabled(method string) bool {
+	serviceName, methodName, ok := m.split(method)
+	if !ok {
+		return false
+	}
+	m.mutex.Lock()
+	service := m.disabled[serviceName]
+	m.mutex.Unlock()
+	return service != nil && service.methods[strings.ToLower(methodName)] != nil
+}
+
+// split returns the service and method names of method, split on the first
+// separator found in it.
+func (m *serviceMap) split(method string) (string, string, bool) {
+	separators := m.separators
+	if len(separators) == 0 {
+		separators = []string{MethodSeparator}
+	}
+	for _, separator := range separators {
+		if parts := strings.Split(method, separator); len(parts) == 2 {
+			return parts[0], parts[1], true
+		}
+	}
+	return "", "", false
+}
+
+// newService returns a service using reflection to extract its methods.
+func newService(rcvr interface{}, name string) (*service, error) {
 	// Setup service.
 	s := &service{
 		name:     name,
@@ -60,11 +178,11 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 	if name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
 		if !isExported(s.name) {
-			return fmt.Errorf("rpc: type %q is not exported", s.name)
+			return nil, fmt.Errorf("rpc: type %q is not exported", s.name)
 		}
 	}
 	if s.name == "" {
-		return fmt.Errorf("rpc: no service name for type %q",
+		return nil, fmt.Errorf("rpc: no service name for type %q",
 			s.rcvrType.String())
 	}
 	// Setup methods.
@@ -75,22 +193,41 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 4 {
+		// Method needs four ins: receiver, *http.Request or context.Context,
+		// *args, *reply, or five ins: receiver, context.Context, RequestID,
+		// *args, *reply.
+		withContext, withID := false, false
+		switch mtype.NumIn() {
+		case 4:
+			// First argument must be context.Context, or a pointer and must
+			// be http.Request.
+			reqType := mtype.In(1)
+			if reqType == typeOfContext {
+				withContext = true
+			} else if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
+				continue
+			}
+		case 5:
+			// First argument must be context.Context, second a RequestID.
+			if mtype.In(1) != typeOfContext || mtype.In(2) != typeOfRequestID {
+				continue
+			}
+			withID = true
+		default:
 			continue
 		}
-		// First argument must be a pointer and must be http.Request.
-		reqType := mtype.In(1)
-		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
-			continue
+		// Args argument must be a pointer and must be exported, or be the
+		// raw params.
+		args := mtype.In(mtype.NumIn() - 2)
+		argsByValue := args == typeOfRawMessage
+		if argsByValue {
+			args = reflect.PtrTo(args)
 		}
-		// Second argument must be a pointer and must be exported.
-		args := mtype.In(2)
 		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
 			continue
 		}
-		// Third argument must be a pointer and must be exported.
-		reply := mtype.In(3)
+		// Reply argument must be a pointer and must be exported.
+		reply := mtype.In(mtype.NumIn() - 1)
 		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
 			continue
 		}
@@ -104,52 +241,97 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 
 		// convert method name to lower case for use in Ethereum
 		s.methods[strings.ToLower(method.Name)] = &serviceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
+			method:      method,
+			argsType:    args.Elem(),
+			replyType:   reply.Elem(),
+			withContext: withContext,
+			withID:      withID,
+			argsByValue: argsByValue,
 		}
 	}
 	if len(s.methods) == 0 {
-		return fmt.Errorf("rpc: %q has no exported methods of suitable type",
+		return nil, fmt.Errorf("rpc: %q has no exported methods of suitable type",
 			s.name)
 	}
-	// Add to the map.
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if m.services == nil {
-		m.services = make(map[string]*service)
-	} else if _, ok := m.services[s.name]; ok {
-		return fmt.Errorf("rpc: service already defined: %q", s.name)
-	}
-	m.services[s.name] = s
-	return nil
+	return s, nil
+}
+
+// ErrMethodNotFound is matched, with errors.Is, by the error of a call to a
+// method that isn't registered. The error itself names the method.
+var ErrMethodNotFound = errors.New("rpc: method not found")
+
+// methodNotFoundError is the error of a call to a method that isn't
+// registered.
+type methodNotFoundError struct {
+	message string
+}
+
+func (e *methodNotFoundError) Error() string {
+	return e.message
+}
+
+func (e *methodNotFoundError) Is(target error) bool {
+	return target == ErrMethodNotFound
 }
 
 // get returns a registered service given a method name.
 //
 // The method name uses a dotted notation as in "Service.Method".
 func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
-	parts := strings.Split(method, MethodSeparator)
-	if len(parts) != 2 {
-		err := fmt.Errorf("rpc: service/method request ill-formed: %q", method)
+	serviceName, methodName, ok := m.split(method)
+	if !ok {
+		err := &methodNotFoundError{fmt.Sprintf("rpc: service/method request ill-formed: %q", method)}
 		return nil, nil, err
 	}
 	m.mutex.Lock()
-	service := m.services[parts[0]]
+	service := m.services[serviceName]
 	m.mutex.Unlock()
 	if service == nil {
-		err := fmt.Errorf("rpc: can't find service %q", method)
+		err := &methodNotFoundError{fmt.Sprintf("rpc: can't find service %q", method)}
 		return nil, nil, err
 	}
 
-	serviceMethod := service.methods[strings.ToLower(parts[1])]
+	serviceMethod := service.methods[strings.ToLower(methodName)]
 	if serviceMethod == nil {
-		err := fmt.Errorf("rpc: can't find method %q", method)
+		err := &methodNotFoundError{fmt.Sprintf("rpc: can't find method %q", method)}
 		return nil, nil, err
 	}
 	return service, serviceMethod, nil
 }
 
+// addAlias makes a registered method reachable as alias too.
+func (m *serviceMap) addAlias(alias, method string) error {
+	if _, _, err := m.get(method); err != nil {
+		return err
+	}
+	if _, _, err := m.get(alias); err == nil {
+		return fmt.Errorf("rpc: alias %q shadows a method", alias)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.aliases == nil {
+		m.aliases = make(map[string]string)
+	} else if _, ok := m.aliases[alias]; ok {
+		return fmt.Errorf("rpc: alias already defined: %q", alias)
+	}
+	m.aliases[alias] = method
+	return nil
+}
+
+// resolve returns the method the given alias stands for, or method itself if
+// it is a registered method or not an alias.
+func (m *serviceMap) resolve(method string) string {
+	if _, _, err := m.get(method); err == nil {
+		return method
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if target, ok := m.aliases[method]; ok {
+		return target
+	}
+	return method
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
@@ -0,0 +1,94 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is the error of a call rejected by the function set with
+// WithRateLimiter.
+var ErrRateLimited = errors.New("rpc: rate limited")
+
+// maxIdleBuckets is the number of buckets above which full buckets, whose
+// clients have been idle long enough, are dropped.
+const maxIdleBuckets = 1024
+
+// rateLimitSweepInterval is how often the idle buckets are dropped.
+const rateLimitSweepInterval = time.Minute
+
+// ipRateLimiter is a token bucket rate limiter keyed by remote IP.
+type ipRateLimiter struct {
+	rate      float64 // tokens added per second
+	burst     float64 // bucket capacity
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPRateLimiter(rps, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:    float64(rps),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the given remote address. When no
+// token is available, it returns false and the time to wait for the next one.
+func (l *ipRateLimiter) allow(remoteAddr string, now time.Time) (bool, time.Duration) {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.buckets) > maxIdleBuckets && now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.lastSweep = now
+		for key, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+	}
+
+	b := l.buckets[ip]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		if l.rate <= 0 {
+			return false, 0
+		}
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refill returns the tokens held by b at the given time.
+func (l *ipRateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(l.burst, b.tokens+elapsed*l.rate)
+}
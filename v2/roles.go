@@ -0,0 +1,49 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrMethodForbidden is the error of a call to a method the role of the
+// caller is not allowed to call, see WithRoleMethodAllowlist.
+var ErrMethodForbidden = errors.New("rpc: method not allowed for this role")
+
+type roleKey struct{}
+
+// ContextWithRole returns a copy of ctx holding the role of the caller. It is
+// typically called from the function registered with RegisterInterceptFunc,
+// once the caller is authenticated.
+func ContextWithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// RoleFromContext returns the role of the caller, or an empty string if none
+// was set with ContextWithRole.
+func RoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey{}).(string)
+	return role
+}
+
+// roleAllowlist holds the methods each role is allowed to call.
+type roleAllowlist map[string]map[string]bool
+
+func newRoleAllowlist(allowlist map[string][]string) roleAllowlist {
+	roles := make(roleAllowlist, len(allowlist))
+	for role, methods := range allowlist {
+		roles[role] = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			roles[role][method] = true
+		}
+	}
+	return roles
+}
+
+func (a roleAllowlist) allows(role, method string) bool {
+	return a[role][method]
+}
@@ -7,16 +7,27 @@ package rpc
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"reflect"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var MethodSeparator = "."
 
 var nilErrorValue = reflect.Zero(reflect.TypeOf((*error)(nil)).Elem())
 
+// ErrGetNotAllowed is the error of a call over HTTP GET to a method not
+// allowed by WithGetMethods.
+var ErrGetNotAllowed = errors.New("rpc: method can't be called with GET")
+
 // ----------------------------------------------------------------------------
 // Codec
 // ----------------------------------------------------------------------------
@@ -39,16 +50,310 @@ type CodecRequest interface {
 	WriteError(ctx context.Context, w http.ResponseWriter, status int, err error)
 }
 
+// ContextCodecRequest is implemented by a CodecRequest that attaches values
+// to the context the service method is called with, e.g. the request id.
+type ContextCodecRequest interface {
+	CodecRequest
+	// Returns the context to use for the method call, derived from ctx.
+	Context(ctx context.Context) context.Context
+}
+
+// RequestID is the id of a request, in the encoding of its codec, e.g. the
+// raw JSON value of the id for JSON-RPC.
+type RequestID []byte
+
+// IDCodecRequest is implemented by a CodecRequest whose requests carry an id.
+// The id is passed to the service methods that take a RequestID argument.
+type IDCodecRequest interface {
+	CodecRequest
+	// Returns the request id, or nil if the request has none.
+	ID() RequestID
+}
+
+// ParamsCodecRequest is implemented by a CodecRequest exposing the params of
+// its request, in the encoding of its codec. They are passed to the
+// interceptors registered with RegisterInterceptor.
+type ParamsCodecRequest interface {
+	CodecRequest
+	// Returns the raw params, or nil if the request has none.
+	Params() json.RawMessage
+}
+
+// ReplyCheckingCodec is implemented by a Codec that can tell, when a service
+// is registered, that it can't encode the replies of one of its methods.
+type ReplyCheckingCodec interface {
+	Codec
+	// Returns why replies of type t can't be encoded, or nil.
+	CheckReplyType(t reflect.Type) error
+}
+
+// ResolvedMethodCodecRequest is implemented by a CodecRequest having options
+// set per method. It is told the canonical name of the method called, as in
+// "Service.Method", once aliases and the spelling of the name are resolved.
+type ResolvedMethodCodecRequest interface {
+	CodecRequest
+	// Sets the name of the method called. A non-nil error is written back
+	// instead of calling the method.
+	SetResolvedMethod(method string) error
+}
+
+// BatchCodec is implemented by a Codec supporting batches of requests sent in
+// a single HTTP request. Each request of a batch is served as if it had been
+// sent alone, then their responses are written back together.
+type BatchCodec interface {
+	Codec
+	// Returns a request per element of the batch sent in r, or false if r
+	// doesn't hold a batch, in which case r can still be served alone.
+	SplitBatch(r *http.Request) ([]*http.Request, bool)
+	// Writes the responses of the requests of a batch, in the same order.
+	// The response of a request that doesn't have one is empty.
+	WriteBatch(w http.ResponseWriter, r *http.Request, responses [][]byte)
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
 
+type options struct {
+	dryRunHeader        string
+	requiredHeaders     map[string]string
+	ipRateLimiter       *ipRateLimiter
+	costBudget          int
+	loadShedder         *loadShedder
+	roleAllowlist       roleAllowlist
+	idempotency         IdempotencyStore
+	idempotencyTTL      time.Duration
+	idempotencyCalls    *idempotencyCalls
+	idempotencyMaxBody  int64
+	getMethods          map[string]bool
+	batchConcurrency    int
+	methodTimeout       time.Duration
+	methodTimeouts      map[string]time.Duration
+	circuitBreakers     map[string]*circuitBreaker
+	rateLimiter         func(method string) bool
+	methodSeparators    []string
+	readCoalescer       *readCoalescer
+	errorMappers        map[string]func(context.Context, error) error
+	requireErrorMapping bool
+	now                 func() time.Time
+}
+
+// Option configures a Server, see NewServer.
+type Option interface {
+	apply(opts *options)
+}
+
+type optionFunc func(opts *options)
+
+func (f optionFunc) apply(opts *options) {
+	f(opts)
+}
+
+// WithDryRunHeader makes requests carrying the given header set to "true"
+// only decode and validate their arguments. The service method is not
+// invoked and an empty reply is written back. Codecs can tell a dry run
+// with DryRunFromContext.
+func WithDryRunHeader(header string) Option {
+	return optionFunc(func(opts *options) { opts.dryRunHeader = header })
+}
+
+type dryRunKey struct{}
+
+// DryRunFromContext returns true if the request is a dry run, see
+// WithDryRunHeader.
+func DryRunFromContext(ctx context.Context) bool {
+	return ctx.Value(dryRunKey{}) != nil
+}
+
+// WithRequiredHeaders rejects requests not carrying all the given headers
+// with a 400 Bad Request status, before any decoding happens. A header mapped
+// to a non-empty value must also have that exact value.
+func WithRequiredHeaders(headers map[string]string) Option {
+	return optionFunc(func(opts *options) { opts.requiredHeaders = headers })
+}
+
+// WithPerIPRateLimit limits the rate of requests coming from each remote IP
+// using a token bucket refilled with rps tokens per second and holding up to
+// burst tokens. Requests over the limit are rejected with a 429 Too Many
+// Requests status and a Retry-After header.
+func WithPerIPRateLimit(rps int, burst int) Option {
+	return optionFunc(func(opts *options) { opts.ipRateLimiter = newIPRateLimiter(rps, burst) })
+}
+
+// WithRateLimiter calls allow with the method of every call before it is
+// dispatched, e.g. to check a token bucket per method. Calls for which it
+// returns false are rejected with ErrRateLimited. In a batch, only those
+// calls are rejected.
+func WithRateLimiter(allow func(method string) bool) Option {
+	return optionFunc(func(opts *options) { opts.rateLimiter = allow })
+}
+
+// WithCostBudget limits the cost a single call can accumulate with AddCost
+// to max units.
+func WithCostBudget(max int) Option {
+	return optionFunc(func(opts *options) { opts.costBudget = max })
+}
+
+// WithLoadShedding rejects a fraction of the calls with ErrServerBusy while
+// the server is degraded. healthFn is called for every call and returns the
+// fraction of calls to reject, between 0 (healthy) and 1. Calls to the
+// critical methods are never rejected.
+func WithLoadShedding(healthFn func() float64, criticalMethods []string) Option {
+	return optionFunc(func(opts *options) { opts.loadShedder = newLoadShedder(healthFn, criticalMethods) })
+}
+
+// WithRoleMethodAllowlist maps roles to the methods they are allowed to call.
+// The role of the caller is read from the request context, see
+// ContextWithRole. Other calls are rejected with ErrMethodForbidden before
+// the validation function registered with RegisterValidateRequestFunc.
+func WithRoleMethodAllowlist(allowlist map[string][]string) Option {
+	return optionFunc(func(opts *options) { opts.roleAllowlist = newRoleAllowlist(allowlist) })
+}
+
+// WithIdempotencyKeys stores in store, for ttl, the response of each request
+// carrying an "Idempotency-Key" header. A request retried with the same key
+// gets the stored response back without being executed again. Responses with
+// a 5xx status code are not stored, so that such requests can be retried.
+//
+// Keys are scoped to the caller, identified by the Authorization and Cookie
+// headers of the request. A key reused by the caller for a request with
+// another body is rejected with a 422 Unprocessable Entity status. While a
+// request is executed, the identical requests received by the server wait
+// for its response.
+//
+// The body of a request carrying a key is read whole to identify it, and is
+// rejected with a 413 Request Entity Too Large status beyond
+// DefaultIdempotencyMaxBody bytes, see WithIdempotencyMaxBody.
+func WithIdempotencyKeys(store IdempotencyStore, ttl time.Duration) Option {
+	return optionFunc(func(opts *options) {
+		opts.idempotency = store
+		opts.idempotencyTTL = ttl
+		opts.idempotencyCalls = newIdempotencyCalls()
+	})
+}
+
+// WithIdempotencyMaxBody sets the size above which the body of a request
+// carrying an "Idempotency-Key" header is rejected, see WithIdempotencyKeys.
+// A zero or negative n uses DefaultIdempotencyMaxBody.
+func WithIdempotencyMaxBody(n int64) Option {
+	return optionFunc(func(opts *options) { opts.idempotencyMaxBody = n })
+}
+
+// WithGetMethods accepts HTTP GET requests calling the given methods, which
+// must be read-only, so that their responses can be cached, e.g. by a CDN.
+// How calls are encoded in the URL is defined by the codec. Calls to other
+// methods over GET are rejected with ErrGetNotAllowed.
+func WithGetMethods(methods ...string) Option {
+	return optionFunc(func(opts *options) {
+		opts.getMethods = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			opts.getMethods[method] = true
+		}
+	})
+}
+
+// WithBatchConcurrency serves up to n requests of a batch concurrently
+// instead of one after the other. Responses are still written in the order
+// of the requests.
+func WithBatchConcurrency(n int) Option {
+	return optionFunc(func(opts *options) { opts.batchConcurrency = n })
+}
+
+// WithMethodTimeout limits the duration of each call to d, or to the
+// duration found in perMethod for its method. The context of the call is
+// canceled once its timeout expires, and ErrMethodTimeout is written back
+// right away, without waiting for the method: whatever it replies later is
+// discarded. Methods should still return early when their context is done,
+// and must not use the request afterwards. A zero duration means no timeout.
+func WithMethodTimeout(d time.Duration, perMethod map[string]time.Duration) Option {
+	return optionFunc(func(opts *options) {
+		opts.methodTimeout = d
+		opts.methodTimeouts = perMethod
+	})
+}
+
+// WithCircuitBreaker fast-fails the calls to method with ErrCircuitOpen once
+// the fraction of them returning an error reaches config.ErrorRate, until
+// config.Cooldown is over. This keeps a failing backend from slowing down
+// the whole server.
+func WithCircuitBreaker(method string, config CircuitBreakerConfig) Option {
+	return optionFunc(func(opts *options) {
+		if opts.circuitBreakers == nil {
+			opts.circuitBreakers = make(map[string]*circuitBreaker)
+		}
+		opts.circuitBreakers[method] = newCircuitBreaker(config)
+	})
+}
+
+// WithErrorMapping maps the errors returned by method with mapper before
+// they are written, e.g. to turn internal errors into codec errors such as a
+// *json2.Error. Returning nil makes the call succeed.
+func WithErrorMapping(method string, mapper func(ctx context.Context, err error) error) Option {
+	return optionFunc(func(opts *options) {
+		if opts.errorMappers == nil {
+			opts.errorMappers = make(map[string]func(context.Context, error) error)
+		}
+		opts.errorMappers[method] = mapper
+	})
+}
+
+// WithRequireErrorMapping makes RegisterService fail for services having a
+// method without an error mapping set by WithErrorMapping, so that the
+// errors of every method are mapped deliberately. The methods are named as
+// in "Service.Method", with the first separator set by WithMethodSeparator.
+func WithRequireErrorMapping(require bool) Option {
+	return optionFunc(func(opts *options) { opts.requireErrorMapping = require })
+}
+
+// WithMethodSeparator sets the separators of the service and method names in
+// method names, e.g. "_" to call the "getBalance" method of the "eth" service
+// as "eth_getBalance". A method name is split on the first of them it holds
+// exactly once. It defaults to MethodSeparator.
+//
+// The methods given to the other options are named with the first
+// separator, e.g. "eth_getBalance" for a call to "eth.getbalance" with the
+// "_" and "." separators. The hooks get that name in
+// RequestInfo.ResolvedMethod.
+func WithMethodSeparator(separators ...string) Option {
+	return optionFunc(func(opts *options) { opts.methodSeparators = separators })
+}
+
+// WithReadCoalesceWindow shares one execution between the identical calls to
+// the given read-only methods made within d of each other: a call with the
+// same method and params as a call started less than d ago, even if that
+// call already completed, gets its result instead of being executed.
+// Params are only known to codecs implementing ParamsCodecRequest, and are
+// compared as sent, without normalizing them.
+//
+// Only methods whose reply depends on nothing but their params qualify: the
+// caller, its headers and its context are ignored when matching calls. Each
+// call gets a deep copy of the shared reply.
+func WithReadCoalesceWindow(d time.Duration, methods ...string) Option {
+	return optionFunc(func(opts *options) { opts.readCoalescer = newReadCoalescer(d, methods) })
+}
+
+// WithClock sets the function used by the server to get the current time.
+// It defaults to time.Now and is mostly useful in tests.
+func WithClock(now func() time.Time) Option {
+	return optionFunc(func(opts *options) { opts.now = now })
+}
+
 // NewServer returns a new RPC server.
-func NewServer() *Server {
-	return &Server{
+func NewServer(opts ...Option) *Server {
+	s := &Server{
 		codecs:   make(map[string]Codec),
 		services: new(serviceMap),
+		options: options{
+			now: time.Now,
+		},
+	}
+
+	for _, opt := range opts {
+		opt.apply(&s.options)
 	}
+	s.services.separators = s.methodSeparators
+
+	return s
 }
 
 // RequestInfo contains all the information we pass to before/after functions
@@ -57,6 +362,9 @@ type RequestInfo struct {
 	Error      error
 	Request    *http.Request
 	StatusCode int
+	// ResolvedMethod is the canonical name of the method called, see
+	// WithMethodSeparator, while Method is the name the request used.
+	ResolvedMethod string
 }
 
 // Server serves registered RPC services using registered codecs.
@@ -67,6 +375,8 @@ type Server struct {
 	beforeFunc    func(i *RequestInfo, args interface{})
 	afterFunc     func(i *RequestInfo)
 	validateFunc  reflect.Value
+	interceptors  []Interceptor
+	options
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -116,6 +426,13 @@ func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
 	s.afterFunc = f
 }
 
+// RegisterInterceptor adds an interceptor called around every method call.
+// Interceptors are nested in registration order: the first one registered is
+// called first and the method is called by the last one.
+func (s *Server) RegisterInterceptor(i Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
 // RegisterService adds a new service to the server.
 //
 // The name parameter is optional: if empty it will be inferred from
@@ -131,16 +448,91 @@ func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
 //    - The second and third arguments are exported or local.
 //    - The method has return type error.
 //
+// The first argument can also be a context.Context instead of the
+// *http.Request, for methods not depending on HTTP. Methods can also take
+// four arguments: context.Context, RequestID, *args, *reply. The context is
+// the one of the http.Request and the RequestID is provided by codecs
+// implementing IDCodecRequest.
+//
+// The args can also be a json.RawMessage instead of a pointer, for methods
+// decoding their params themselves, e.g. after looking at a discriminator.
+//
 // All other methods are ignored.
+//
+// The codecs already registered that implement ReplyCheckingCodec check the
+// reply types of the methods, and the service is rejected if one of them
+// can't be encoded.
+//
+// When WithRequireErrorMapping is set, an error is returned if one of the
+// methods has no error mapping.
+//
+// A method can panic with a value having a ToError method, e.g. a
+// *json2.Error: the panic is recovered and the error returned by ToError is
+// the result of the method.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
+	replyTypes, err := s.services.replyTypes(receiver, name)
+	if err != nil {
+		return err
+	}
+	for _, codec := range s.codecs {
+		checker, ok := codec.(ReplyCheckingCodec)
+		if !ok {
+			continue
+		}
+		for method, t := range replyTypes {
+			if err := checker.CheckReplyType(t); err != nil {
+				return fmt.Errorf("rpc: method %q: %v", method, err)
+			}
+		}
+	}
+	if s.requireErrorMapping {
+		methods, err := s.services.methodNames(receiver, name)
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			if s.errorMappers[method] == nil {
+				return fmt.Errorf("rpc: no error mapping for method %q", method)
+			}
+		}
+	}
 	return s.services.register(receiver, name)
 }
 
-// HasMethod returns true if the given method is registered.
+// RegisterServiceIf registers the service like RegisterService if cond is
+// true, e.g. when a feature flag is set. Otherwise the service is recorded as
+// disabled, see IsMethodDisabled.
+func (s *Server) RegisterServiceIf(cond bool, receiver interface{}, name string) error {
+	if cond {
+		return s.RegisterService(receiver, name)
+	}
+	return s.services.disable(receiver, name)
+}
+
+// IsMethodDisabled returns true if the given method belongs to a service
+// that was not registered by RegisterServiceIf.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) IsMethodDisabled(method string) bool {
+	return s.services.isDisabled(method)
+}
+
+// RegisterAlias makes a registered method reachable under another name too,
+// e.g. "multiply" or "eth_multiply" for "Service1.Multiply", to keep the
+// method names of another framework. The alias can't be the name of a
+// registered method, and the methods registered later take precedence over
+// it. Calls made through the alias are served as calls to the method, whose
+// name is used for the server options set per method.
+func (s *Server) RegisterAlias(alias, method string) error {
+	return s.services.addAlias(alias, method)
+}
+
+// HasMethod returns true if the given method is registered, or is an alias
+// of a registered method.
 //
 // The method uses a dotted notation as in "Service.Method".
 func (s *Server) HasMethod(method string) bool {
-	if _, _, err := s.services.get(method); err == nil {
+	if _, _, err := s.services.get(s.services.resolve(method)); err == nil {
 		return true
 	}
 	return false
@@ -148,10 +540,36 @@ func (s *Server) HasMethod(method string) bool {
 
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+	if r.Method != "POST" && (r.Method != "GET" || s.getMethods == nil) {
 		WriteError(w, http.StatusMethodNotAllowed, "rpc: POST method required, received "+r.Method)
 		return
 	}
+	for name, value := range s.requiredHeaders {
+		if got := r.Header.Get(name); got == "" || (value != "" && got != value) {
+			WriteError(w, http.StatusBadRequest, "rpc: missing or invalid required header "+name)
+			return
+		}
+	}
+	if s.ipRateLimiter != nil {
+		if ok, wait := s.ipRateLimiter.allow(r.RemoteAddr, s.now()); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			WriteError(w, http.StatusTooManyRequests, "rpc: rate limit exceeded")
+			return
+		}
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" && s.idempotency != nil {
+		s.serveIdempotent(w, r, key, s.serveCodec)
+		return
+	}
+	s.serveCodec(w, r)
+}
+
+// serveCodec serves r using the codec registered for its content type.
+func (s *Server) serveCodec(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	idx := strings.Index(contentType, ";")
 	if idx != -1 {
@@ -168,6 +586,22 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, http.StatusUnsupportedMediaType, "rpc: unrecognized Content-Type: "+contentType)
 		return
 	}
+	if batchCodec, ok := codec.(BatchCodec); ok {
+		if requests, ok := batchCodec.SplitBatch(r); ok {
+			s.serveBatch(w, r, batchCodec, requests)
+			return
+		}
+	}
+	s.serveRequest(w, r, codec)
+}
+
+// serveRequest serves a single request using codec.
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request, codec Codec) {
+	// A dry run stops once the request has been validated
+	dryRun := s.dryRunHeader != "" && r.Header.Get(s.dryRunHeader) == "true"
+	if dryRun {
+		r = r.WithContext(context.WithValue(r.Context(), dryRunKey{}, true))
+	}
 	// Create a new codec request.
 	codecReq := codec.NewRequest(r)
 	// Get service method to be called.
@@ -176,11 +610,34 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		codecReq.WriteError(r.Context(), w, http.StatusBadRequest, errMethod)
 		return
 	}
+	method = s.services.resolve(method)
 	serviceSpec, methodSpec, errGet := s.services.get(method)
 	if errGet != nil {
 		codecReq.WriteError(r.Context(), w, http.StatusBadRequest, errGet)
 		return
 	}
+	// The per-method options get the canonical name of the method, whatever
+	// its spelling, while the hooks keep the name the request used.
+	requested := method
+	method = s.services.name(serviceSpec, methodSpec)
+	if resolvedReq, ok := codecReq.(ResolvedMethodCodecRequest); ok {
+		if err := resolvedReq.SetResolvedMethod(method); err != nil {
+			codecReq.WriteError(r.Context(), w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if r.Method == "GET" && !s.getMethods[method] {
+		codecReq.WriteError(r.Context(), w, http.StatusMethodNotAllowed, ErrGetNotAllowed)
+		return
+	}
+	if s.rateLimiter != nil && !s.rateLimiter(method) {
+		codecReq.WriteError(r.Context(), w, http.StatusTooManyRequests, ErrRateLimited)
+		return
+	}
+	if s.loadShedder != nil && s.loadShedder.shed(method) {
+		codecReq.WriteError(r.Context(), w, http.StatusServiceUnavailable, ErrServerBusy)
+		return
+	}
 	// Decode the args.
 	args := reflect.New(methodSpec.argsType)
 	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
@@ -188,11 +645,16 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if contextReq, ok := codecReq.(ContextCodecRequest); ok {
+		r = r.WithContext(contextReq.Context(r.Context()))
+	}
+
 	// Call the registered Intercept Function
 	if s.interceptFunc != nil {
 		req := s.interceptFunc(&RequestInfo{
-			Request: r,
-			Method:  method,
+			Request:        r,
+			Method:         requested,
+			ResolvedMethod: method,
 		})
 		if req != nil {
 			r = req
@@ -200,8 +662,9 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	requestInfo := &RequestInfo{
-		Request: r,
-		Method:  method,
+		Request:        r,
+		Method:         requested,
+		ResolvedMethod: method,
 	}
 
 	// Call the registered Before Function
@@ -211,39 +674,122 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Prepare the reply, we need it even if validation fails
 	reply := reflect.New(methodSpec.replyType)
+	result := reply.Interface()
 	errValue := []reflect.Value{nilErrorValue}
 
-	// Call the registered Validator Function
-	if s.validateFunc.IsValid() {
+	// Check the role of the caller, then call the registered Validator Function
+	if s.roleAllowlist != nil && !s.roleAllowlist.allows(RoleFromContext(r.Context()), method) {
+		errValue = []reflect.Value{reflect.ValueOf(ErrMethodForbidden)}
+	} else if s.validateFunc.IsValid() {
 		errValue = s.validateFunc.Call([]reflect.Value{reflect.ValueOf(requestInfo), args})
 	}
 
 	// If still no errors after validation, call the method
-	if errValue[0].IsNil() {
-		errValue = methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
-			reflect.ValueOf(r),
-			args,
-			reply,
-		})
+	if errValue[0].IsNil() && !dryRun {
+		var costs *costAccumulator
+		callReq := r
+		if s.costBudget > 0 {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			costs = &costAccumulator{max: s.costBudget, cancel: cancel}
+			callReq = r.WithContext(context.WithValue(ctx, costKey{}, costs))
+		}
+		timeout, ok := s.methodTimeouts[method]
+		if !ok {
+			timeout = s.methodTimeout
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(callReq.Context(), timeout)
+			defer cancel()
+			callReq = callReq.WithContext(ctx)
+		}
+
+		invoke := func(callReq *http.Request) []reflect.Value {
+			in := []reflect.Value{serviceSpec.rcvr, reflect.ValueOf(callReq)}
+			if methodSpec.withContext {
+				in = []reflect.Value{serviceSpec.rcvr, reflect.ValueOf(callReq.Context())}
+			} else if methodSpec.withID {
+				var id RequestID
+				if idReq, ok := codecReq.(IDCodecRequest); ok {
+					id = idReq.ID()
+				}
+				in = []reflect.Value{serviceSpec.rcvr, reflect.ValueOf(callReq.Context()), reflect.ValueOf(id)}
+			}
+			in = append(in, args, reply)
+			if methodSpec.argsByValue {
+				in[len(in)-2] = args.Elem()
+			}
+			if timeout > 0 {
+				return callMethodWithTimeout(callReq.Context(), methodSpec.method.Func, in, isBatchRequest(r))
+			}
+			return callMethod(methodSpec.method.Func, in, isBatchRequest(r))
+		}
+		if mapper := s.errorMappers[method]; mapper != nil {
+			call := invoke
+			invoke = func(callReq *http.Request) []reflect.Value {
+				out := call(callReq)
+				err, ok := out[0].Interface().(error)
+				if _, isRaw := err.(*RawResponse); !ok || isRaw {
+					return out
+				}
+				err = mapper(callReq.Context(), err)
+				return []reflect.Value{reflect.ValueOf(&err).Elem()}
+			}
+		}
+		if paramsReq, ok := codecReq.(ParamsCodecRequest); ok && s.readCoalescer != nil && s.readCoalescer.methods[method] {
+			key := method + "\x00" + string(paramsReq.Params())
+			call := invoke
+			invoke = func(callReq *http.Request) []reflect.Value {
+				return s.readCoalescer.do(key, s.now(), reply, func() []reflect.Value { return call(callReq) })
+			}
+		}
+		breaker := s.circuitBreakers[method]
+		if breaker != nil && !breaker.allow(s.now()) {
+			errValue = []reflect.Value{reflect.ValueOf(ErrCircuitOpen)}
+		} else {
+			errValue = s.callWithBreaker(breaker, func() []reflect.Value {
+				if len(s.interceptors) == 0 {
+					return invoke(callReq)
+				}
+				var err error
+				result, err = s.intercept(callReq, codecReq, requested, reply, invoke)
+				return []reflect.Value{reflect.ValueOf(&err).Elem()}
+			})
+		}
+
+		if costs != nil && costs.exceeded() {
+			errValue = []reflect.Value{reflect.ValueOf(ErrCostBudgetExceeded)}
+		}
 	}
 
 	// Extract the result to error if needed.
 	var errResult error
 	statusCode := http.StatusOK
 	errInter := errValue[0].Interface()
-	if errInter != nil {
+	raw, isRaw := errInter.(*RawResponse)
+	if errInter != nil && !isRaw {
 		statusCode = http.StatusBadRequest
 		errResult = errInter.(error)
+		if errResult == ErrCircuitOpen {
+			statusCode = http.StatusServiceUnavailable
+		}
 	}
 
 	// Prevents Internet Explorer from MIME-sniffing a response away
 	// from the declared content-type
 	w.Header().Set("x-content-type-options", "nosniff")
 
-	// Encode the response.
-	if errResult == nil {
-		codecReq.WriteResponse(w, reply.Interface())
+	// Encode the response, unless the method took it over.
+	if isRaw && isBatchRequest(r) {
+		errResult = ErrNotBatchable
+		statusCode = http.StatusInternalServerError
+		codecReq.WriteError(r.Context(), w, statusCode, errResult)
+	} else if isRaw {
+		raw.ServeHTTP(w, r)
+	} else if errResult == nil && dryRun {
+		codecReq.WriteResponse(w, nil)
+	} else if errResult == nil {
+		codecReq.WriteResponse(w, result)
 	} else {
 		codecReq.WriteError(r.Context(), w, statusCode, errResult)
 	}
@@ -251,14 +797,90 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Call the registered After Function
 	if s.afterFunc != nil {
 		s.afterFunc(&RequestInfo{
-			Request:    r,
-			Method:     method,
-			Error:      errResult,
-			StatusCode: statusCode,
+			Request:        r,
+			Method:         requested,
+			Error:          errResult,
+			StatusCode:     statusCode,
+			ResolvedMethod: method,
 		})
 	}
 }
 
+// callWithBreaker calls call, recording its outcome in breaker unless it is
+// nil. A call that panics is recorded as failed.
+func (s *Server) callWithBreaker(breaker *circuitBreaker, call func() []reflect.Value) []reflect.Value {
+	if breaker == nil {
+		return call()
+	}
+	failed := true
+	defer func() { breaker.done(s.now(), failed) }()
+	errValue := call()
+	_, isRaw := errValue[0].Interface().(*RawResponse)
+	failed = !errValue[0].IsNil() && !isRaw
+	return errValue
+}
+
+// callMethod calls method. A panic with a value having a ToError method that
+// returns an error is recovered, and that error is returned as the result.
+// Other panics are propagated, unless recoverAll is set, in which case they
+// are logged and ErrMethodPanicked is returned.
+func callMethod(method reflect.Value, in []reflect.Value, recoverAll bool) (out []reflect.Value) {
+	defer func() {
+		if v := recover(); v != nil {
+			out = methodPanicked(v, nil, recoverAll)
+		}
+	}()
+	return method.Call(in)
+}
+
+// methodPanicked returns the outcome of a method that panicked with v: the
+// error of its ToError method, or ErrMethodPanicked if recoverAll is true,
+// in which case v is logged along with stack, or the current stack if nil.
+// Other panics are propagated.
+func methodPanicked(v interface{}, stack []byte, recoverAll bool) []reflect.Value {
+	err := panicError(v)
+	if err == nil && !recoverAll {
+		panic(v)
+	}
+	if err == nil {
+		if stack == nil {
+			stack = debug.Stack()
+		}
+		log.Printf("rpc: panic calling method: %v\n%s", v, stack)
+		err = ErrMethodPanicked
+	}
+	return []reflect.Value{reflect.ValueOf(err)}
+}
+
+// panicError returns the error returned by the ToError method of the panic
+// value v, or nil if it has no such method.
+func panicError(v interface{}) error {
+	toError := reflect.ValueOf(v).MethodByName("ToError")
+	if !toError.IsValid() {
+		return nil
+	}
+	if t := toError.Type(); t.NumIn() != 0 || t.NumOut() != 1 || !t.Out(0).Implements(typeOfError) {
+		return nil
+	}
+	err := toError.Call(nil)[0]
+	if (err.Kind() == reflect.Ptr || err.Kind() == reflect.Interface) && err.IsNil() {
+		return nil
+	}
+	return err.Interface().(error)
+}
+
+// RawResponse can be returned as an error by a service method to bypass the
+// codec: the request is then served by Handler, which takes over the
+// ResponseWriter, e.g. to send a file download. In a batch, the request is
+// answered with ErrNotBatchable instead.
+type RawResponse struct {
+	http.Handler
+}
+
+func (r *RawResponse) Error() string {
+	return "rpc: raw response"
+}
+
 func WriteError(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(status)
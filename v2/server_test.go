@@ -9,8 +9,13 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Service1Request struct {
@@ -116,6 +121,32 @@ func (w *MockResponseWriter) WriteHeader(status int) {
 	w.Status = status
 }
 
+func TestRegisterServiceIf(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterServiceIf(true, new(Service1), ""); err != nil || !s.HasMethod("Service1.Multiply") {
+		t.Errorf("Expected to be registered: Service1.Multiply")
+	}
+	if s.IsMethodDisabled("Service1.Multiply") {
+		t.Errorf("Expected not to be disabled: Service1.Multiply")
+	}
+	if err := s.RegisterServiceIf(false, new(Service1), "Experimental"); err != nil {
+		t.Errorf("Expected err to be nil, got %v", err)
+	}
+	if s.HasMethod("Experimental.Multiply") {
+		t.Errorf("Expected not to be registered: Experimental.Multiply")
+	}
+	if !s.IsMethodDisabled("Experimental.Multiply") {
+		t.Errorf("Expected to be disabled: Experimental.Multiply")
+	}
+	if s.IsMethodDisabled("Experimental.Divide") {
+		t.Errorf("Expected not to be disabled: Experimental.Divide")
+	}
+	// No methods.
+	if err := s.RegisterServiceIf(false, new(Service2), ""); err == nil {
+		t.Errorf("Expected error on service2")
+	}
+}
+
 func TestServeHTTP(t *testing.T) {
 	const (
 		A = 2
@@ -262,3 +293,721 @@ func TestValidationFails(t *testing.T) {
 		t.Errorf("Response body was %s, should be %s.", w.Body, expected)
 	}
 }
+
+func TestRequiredHeaders(t *testing.T) {
+	s := NewServer(WithRequiredHeaders(map[string]string{
+		"X-Gateway-Token": "secret",
+	}))
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock; dummy")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	r.Header.Set("X-Gateway-Token", "wrong")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	r.Header.Set("X-Gateway-Token", "secret")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if w.Body != "6" {
+		t.Errorf("Response body was %s, should be %s.", w.Body, "6")
+	}
+}
+
+func TestPerIPRateLimit(t *testing.T) {
+	s := NewServer(WithPerIPRateLimit(1, 2))
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func(remoteAddr string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		r.RemoteAddr = remoteAddr
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serve("10.0.0.1:1234"); w.Status != 200 {
+			t.Errorf("Status was %d, should be 200.", w.Status)
+		}
+	}
+	w := serve("10.0.0.1:5678")
+	if w.Status != http.StatusTooManyRequests {
+		t.Errorf("Status was %d, should be 429.", w.Status)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	if w := serve("10.0.0.2:1234"); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+func TestIPRateLimiterSweep(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newIPRateLimiter(1, 1)
+	fill := func() {
+		for i := 0; i <= maxIdleBuckets; i++ {
+			l.allow("10.0.0."+strconv.Itoa(i), now)
+		}
+	}
+
+	fill()
+	now = now.Add(2 * time.Second)
+	l.allow("10.1.0.1", now)
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected the idle buckets to be dropped, but got %d buckets", len(l.buckets))
+	}
+	fill()
+	now = now.Add(2 * time.Second)
+	l.allow("10.1.0.1", now)
+	if len(l.buckets) != maxIdleBuckets+2 {
+		t.Errorf("Expected no sweep within %v, but got %d buckets", rateLimitSweepInterval, len(l.buckets))
+	}
+	now = now.Add(rateLimitSweepInterval)
+	l.allow("10.1.0.1", now)
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected the idle buckets to be dropped, but got %d buckets", len(l.buckets))
+	}
+}
+
+type CostlyService struct {
+	steps int
+}
+
+func (t *CostlyService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	for i := 0; i < 10; i++ {
+		if err := AddCost(r.Context(), 3); err != nil {
+			return err
+		}
+		t.steps++
+	}
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestCostBudget(t *testing.T) {
+	service := new(CostlyService)
+	s := NewServer(WithCostBudget(10))
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock; dummy")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+	if w.Body != ErrCostBudgetExceeded.Error() {
+		t.Errorf("Response body was %s, should be %s.", w.Body, ErrCostBudgetExceeded)
+	}
+	if service.steps != 3 {
+		t.Errorf("Method ran %d steps, should have stopped after 3.", service.steps)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	health := 0.5
+	s := NewServer(WithLoadShedding(func() float64 { return health }, nil))
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	shed := 0
+	for i := 0; i < 10; i++ {
+		if w := serve(); w.Status == http.StatusServiceUnavailable {
+			shed++
+		}
+	}
+	if shed != 5 {
+		t.Errorf("%d calls were shed, should be 5.", shed)
+	}
+
+	// Critical methods always pass.
+	s = NewServer(WithLoadShedding(func() float64 { return 1 }, []string{"Service1.Multiply"}))
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	if w := serve(); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+func TestRoleMethodAllowlist(t *testing.T) {
+	serve := func(role string) *MockResponseWriter {
+		s := NewServer(WithRoleMethodAllowlist(map[string][]string{
+			"reader": {"Service1.Get"},
+			"writer": {"Service1.Get", "Service1.Multiply"},
+		}))
+		s.RegisterService(new(Service1), "")
+		s.RegisterCodec(MockCodec{2, 3}, "mock")
+		s.RegisterInterceptFunc(func(i *RequestInfo) *http.Request {
+			return i.Request.WithContext(ContextWithRole(i.Request.Context(), role))
+		})
+
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("reader"); w.Status != 400 || w.Body != ErrMethodForbidden.Error() {
+		t.Errorf("Expected the reader role to be forbidden, got status %d and body %s.", w.Status, w.Body)
+	}
+	if w := serve("writer"); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+type CountingService struct {
+	calls int
+}
+
+func (t *CountingService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.calls++
+	res.Result = req.A*req.B + t.calls
+	return nil
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	service := new(CountingService)
+	s := NewServer(WithIdempotencyKeys(NewMemoryIdempotencyStore(), time.Minute))
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func(key string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("key-1"); w.Status != 200 || w.Body != "7" {
+		t.Errorf("Expected status 200 and body 7, got status %d and body %s.", w.Status, w.Body)
+	}
+	if w := serve("key-1"); w.Status != 200 || w.Body != "7" {
+		t.Errorf("Expected the stored response, got status %d and body %s.", w.Status, w.Body)
+	} else if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected the stored headers, got %v.", w.Header())
+	}
+	if service.calls != 1 {
+		t.Errorf("Method was called %d times, should be 1.", service.calls)
+	}
+	if w := serve("key-2"); w.Body != "8" {
+		t.Errorf("Response body was %s, should be 8.", w.Body)
+	}
+	if w := serve(""); w.Body != "9" {
+		t.Errorf("Response body was %s, should be 9.", w.Body)
+	}
+}
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	service := new(CountingService)
+	s := NewServer(WithIdempotencyKeys(NewMemoryIdempotencyStore(), time.Minute))
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func(body, authorization string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		r.Header.Set("Idempotency-Key", "key-1")
+		r.Header.Set("Authorization", authorization)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("a", "alice"); w.Status != 200 || w.Body != "7" {
+		t.Errorf("Expected status 200 and body 7, got status %d and body %s.", w.Status, w.Body)
+	}
+	// Another body with the same key is rejected.
+	if w := serve("b", "alice"); w.Status != 422 {
+		t.Errorf("Status was %d, should be 422.", w.Status)
+	}
+	// Another caller doesn't get the stored response.
+	if w := serve("a", "bob"); w.Status != 200 || w.Body != "8" {
+		t.Errorf("Expected status 200 and body 8, got status %d and body %s.", w.Status, w.Body)
+	}
+	if service.calls != 2 {
+		t.Errorf("Method was called %d times, should be 2.", service.calls)
+	}
+
+	// Bodies are only read up to the limit.
+	s = NewServer(WithIdempotencyKeys(NewMemoryIdempotencyStore(), time.Minute), WithIdempotencyMaxBody(4))
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	if w := serve("abcde", "alice"); w.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Status was %d, should be 413.", w.Status)
+	}
+	if w := serve("abcd", "alice"); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+type BlockingService struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t *BlockingService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	if atomic.AddInt32(&t.calls, 1) == 1 {
+		close(t.started)
+	}
+	<-t.release
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestIdempotencyKeyInFlight(t *testing.T) {
+	service := &BlockingService{started: make(chan struct{}), release: make(chan struct{})}
+	s := NewServer(WithIdempotencyKeys(NewMemoryIdempotencyStore(), time.Minute))
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	var wg sync.WaitGroup
+	responses := make([]*MockResponseWriter, 3)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, _ := http.NewRequest("POST", "", strings.NewReader("a"))
+			r.Header.Set("Content-Type", "mock; dummy")
+			r.Header.Set("Idempotency-Key", "key-1")
+			responses[i] = NewMockResponseWriter()
+			s.ServeHTTP(responses[i], r)
+		}(i)
+	}
+	<-service.started
+	time.Sleep(20 * time.Millisecond)
+	close(service.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Errorf("Method was called %d times, should be 1.", calls)
+	}
+	for _, w := range responses {
+		if w.Status != 200 || w.Body != "6" {
+			t.Errorf("Expected status 200 and body 6, got status %d and body %s.", w.Status, w.Body)
+		}
+	}
+}
+
+type contextKey struct{}
+
+type ContextService struct {
+	value interface{}
+}
+
+func (t *ContextService) Multiply(ctx context.Context, req *Service1Request, res *Service1Response) error {
+	t.value = ctx.Value(contextKey{})
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestContextMethod(t *testing.T) {
+	service := new(ContextService)
+	s := NewServer()
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), contextKey{}, "value"))
+	r.Header.Set("Content-Type", "mock; dummy")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if w.Body != "6" {
+		t.Errorf("Response body was %s, should be 6.", w.Body)
+	}
+	if service.value != "value" {
+		t.Errorf("Context value was %v, should be value.", service.value)
+	}
+}
+
+type FlakyService struct {
+	failing   bool
+	panicking bool
+	calls     int
+}
+
+func (t *FlakyService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.calls++
+	if t.panicking {
+		panic("backend crashed")
+	}
+	if t.failing {
+		return errors.New("backend unavailable")
+	}
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	service := &FlakyService{failing: true}
+	s := NewServer(
+		WithClock(func() time.Time { return now }),
+		WithCircuitBreaker("Service1.Multiply", CircuitBreakerConfig{ErrorRate: 0.5, MinCalls: 4, Cooldown: time.Minute}),
+	)
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 4; i++ {
+		if w := serve(); w.Status != 400 {
+			t.Errorf("Status was %d, should be 400.", w.Status)
+		}
+	}
+	// The circuit is open: calls fail fast without reaching the method.
+	if w := serve(); w.Status != http.StatusServiceUnavailable || w.Body != ErrCircuitOpen.Error() {
+		t.Errorf("Expected the circuit to be open, got status %d and body %s.", w.Status, w.Body)
+	}
+	if service.calls != 4 {
+		t.Errorf("Method was called %d times, should be 4.", service.calls)
+	}
+
+	// Once the cooldown is over, a failed trial call opens it again.
+	now = now.Add(time.Minute)
+	if w := serve(); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+	if w := serve(); w.Status != http.StatusServiceUnavailable {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+
+	// A successful trial call closes it.
+	now = now.Add(time.Minute)
+	service.failing = false
+	for i := 0; i < 3; i++ {
+		if w := serve(); w.Status != 200 || w.Body != "6" {
+			t.Errorf("Expected status 200 and body 6, got status %d and body %s.", w.Status, w.Body)
+		}
+	}
+	if service.calls != 8 {
+		t.Errorf("Method was called %d times, should be 8.", service.calls)
+	}
+}
+
+func TestCircuitBreakerPanic(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	service := &FlakyService{failing: true}
+	s := NewServer(
+		WithClock(func() time.Time { return now }),
+		WithCircuitBreaker("Service1.Multiply", CircuitBreakerConfig{ErrorRate: 0.5, MinCalls: 1, Cooldown: time.Minute}),
+	)
+	s.RegisterService(service, "Service1")
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	serve := func() (w *MockResponseWriter, panicked bool) {
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			}
+		}()
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w = NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w, false
+	}
+
+	serve()
+	// A trial call that panics counts as failed.
+	now = now.Add(time.Minute)
+	service.panicking = true
+	if _, panicked := serve(); !panicked {
+		t.Error("Expected the method to panic")
+	}
+	if w, _ := serve(); w.Status != http.StatusServiceUnavailable {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+
+	// The next trial call is let through once the cooldown is over.
+	now = now.Add(time.Minute)
+	service.failing, service.panicking = false, false
+	if w, _ := serve(); w.Status != 200 || w.Body != "6" {
+		t.Errorf("Expected status 200 and body 6, got status %d and body %s.", w.Status, w.Body)
+	}
+}
+
+// MethodCodec decodes to the given method.
+type MethodCodec struct {
+	MockCodec
+	Method string
+}
+
+func (c MethodCodec) NewRequest(*http.Request) CodecRequest {
+	return MethodCodecRequest{MockCodecRequest{c.A, c.B}, c.Method}
+}
+
+type MethodCodecRequest struct {
+	MockCodecRequest
+	method string
+}
+
+func (r MethodCodecRequest) Method() (string, error) {
+	return r.method, nil
+}
+
+func TestRegisterAlias(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	if err := s.RegisterAlias("multiply", "Service1.Multiply"); err != nil {
+		t.Errorf("Expected err to be nil, got %v", err)
+	}
+	if err := s.RegisterAlias("eth_multiply", "Service1.Multiply"); err != nil {
+		t.Errorf("Expected err to be nil, got %v", err)
+	}
+	if !s.HasMethod("multiply") || !s.HasMethod("eth_multiply") {
+		t.Errorf("Expected the aliases to be registered")
+	}
+	if err := s.RegisterAlias("multiply", "Service1.Multiply"); err == nil {
+		t.Errorf("Expected an error on a duplicate alias")
+	}
+	if err := s.RegisterAlias("Service1.Multiply", "Service1.Multiply"); err == nil {
+		t.Errorf("Expected an error on an alias shadowing a method")
+	}
+	if err := s.RegisterAlias("divide", "Service1.Divide"); err == nil {
+		t.Errorf("Expected an error on an alias of an unknown method")
+	}
+
+	s.RegisterCodec(MethodCodec{MockCodec{2, 3}, "eth_multiply"}, "mock")
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock; dummy")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 || w.Body != "6" {
+		t.Errorf("Expected status 200 and body 6, got status %d and body %s.", w.Status, w.Body)
+	}
+}
+
+func TestMethodSeparator(t *testing.T) {
+	serve := func(s *Server, method string) *MockResponseWriter {
+		s.RegisterCodec(MethodCodec{MockCodec{2, 3}, method}, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	s := NewServer(WithMethodSeparator("_", "."))
+	s.RegisterService(new(Service1), "eth")
+	for _, method := range []string{"eth_Multiply", "eth.multiply"} {
+		if !s.HasMethod(method) {
+			t.Errorf("Expected to be registered: %s", method)
+		}
+		if w := serve(s, method); w.Status != 200 || w.Body != "6" {
+			t.Errorf("Expected status 200 and body 6 for %s, got status %d and body %s.", method, w.Status, w.Body)
+		}
+	}
+
+	s = NewServer(WithMethodSeparator("_"))
+	s.RegisterService(new(Service1), "eth")
+	if s.HasMethod("eth.Multiply") {
+		t.Errorf("Expected not to be registered: eth.Multiply")
+	}
+	if w := serve(s, "eth.Multiply"); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	errUnavailable := errors.New("service unavailable, try again later")
+	mapper := func(ctx context.Context, err error) error {
+		return errUnavailable
+	}
+
+	s := NewServer(WithRequireErrorMapping(true))
+	err := s.RegisterService(&FlakyService{failing: true}, "")
+	if err == nil || err.Error() != `rpc: no error mapping for method "FlakyService.Multiply"` {
+		t.Errorf("Expected registration to fail, but got %v", err)
+	}
+	if s.HasMethod("FlakyService.Multiply") {
+		t.Error("Expected not to be registered: FlakyService.Multiply")
+	}
+
+	s = NewServer(WithRequireErrorMapping(true), WithErrorMapping("FlakyService.Multiply", mapper))
+	if err := s.RegisterService(&FlakyService{failing: true}, ""); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	// The mapping applies whatever the spelling of the method.
+	for _, method := range []string{"FlakyService.Multiply", "FlakyService.MULTIPLY"} {
+		s.RegisterCodec(MethodCodec{MockCodec{2, 3}, method}, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != 400 {
+			t.Errorf("Status was %d, should be 400.", w.Status)
+		}
+		if w.Body != errUnavailable.Error() {
+			t.Errorf("Response body was %s, should be %s.", w.Body, errUnavailable)
+		}
+	}
+}
+
+func TestCanonicalMethodName(t *testing.T) {
+	var limited []string
+	s := NewServer(WithMethodSeparator("_", "."), WithRateLimiter(func(method string) bool {
+		limited = append(limited, method)
+		return method != "Service1_Multiply"
+	}))
+	s.RegisterService(new(Service1), "")
+	for _, method := range []string{"Service1_Multiply", "Service1.MULTIPLY", "Service1_multiply"} {
+		s.RegisterCodec(MethodCodec{MockCodec{2, 3}, method}, "mock")
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock; dummy")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != 429 {
+			t.Errorf("Status was %d for %s, should be 429.", w.Status, method)
+		}
+	}
+	for _, method := range limited {
+		if method != "Service1_Multiply" {
+			t.Errorf("Expected the rate limiter to get Service1_Multiply, but got %s", method)
+		}
+	}
+
+	// The hooks keep the name the request used.
+	var infos []RequestInfo
+	s = NewServer(WithMethodSeparator("_", "."))
+	s.RegisterService(new(Service1), "")
+	s.RegisterCodec(MethodCodec{MockCodec{2, 3}, "Service1.MULTIPLY"}, "mock")
+	s.RegisterBeforeFunc(func(i *RequestInfo, args interface{}) { infos = append(infos, *i) })
+	s.RegisterAfterFunc(func(i *RequestInfo) { infos = append(infos, *i) })
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock; dummy")
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	if len(infos) != 2 {
+		t.Fatalf("Expected the hooks to be called twice, but got %d calls", len(infos))
+	}
+	for _, info := range infos {
+		if info.Method != "Service1.MULTIPLY" || info.ResolvedMethod != "Service1_Multiply" {
+			t.Errorf("Expected Service1.MULTIPLY resolved to Service1_Multiply, but got %s and %s", info.Method, info.ResolvedMethod)
+		}
+	}
+}
+
+type CoalescedReply struct {
+	Values []int
+	Labels map[string]*string
+}
+
+func TestReadCoalescerCopiesReply(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newReadCoalescer(time.Minute, nil)
+	label := "a"
+	fill := func(reply reflect.Value) func() []reflect.Value {
+		return func() []reflect.Value {
+			reply.Interface().(*CoalescedReply).Values = []int{1, 2}
+			reply.Interface().(*CoalescedReply).Labels = map[string]*string{"a": &label}
+			return []reflect.Value{reflect.Zero(reflect.TypeOf((*error)(nil)).Elem())}
+		}
+	}
+
+	first := new(CoalescedReply)
+	c.do("key", now, reflect.ValueOf(first), fill(reflect.ValueOf(first)))
+	first.Values[0] = 10
+	*first.Labels["a"] = "changed"
+
+	second := new(CoalescedReply)
+	c.do("key", now, reflect.ValueOf(second), func() []reflect.Value {
+		t.Fatal("Expected the call to be coalesced")
+		return nil
+	})
+	if second.Values[0] != 1 || *second.Labels["a"] != "a" {
+		t.Errorf("Expected an unmodified copy of the reply, but got %v %q", second.Values, *second.Labels["a"])
+	}
+	second.Values[1] = 20
+
+	third := new(CoalescedReply)
+	c.do("key", now, reflect.ValueOf(third), nil)
+	if third.Values[1] != 2 {
+		t.Errorf("Expected each call to get its own copy, but got %v", third.Values)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"runtime/debug"
+)
+
+// ErrMethodTimeout is the error of a call that didn't complete before its
+// timeout, see WithMethodTimeout.
+var ErrMethodTimeout = errors.New("rpc: method timed out")
+
+// methodResult is the outcome of a method called by callMethodWithTimeout.
+type methodResult struct {
+	out      []reflect.Value
+	panicked bool
+	value    interface{}
+	stack    []byte
+}
+
+// callMethodWithTimeout calls method like callMethod, but returns
+// ErrMethodTimeout as soon as the deadline of ctx is exceeded, without
+// waiting for the method to return.
+//
+// The method runs in its own goroutine on a private reply, the last value of
+// in, which is copied to the actual reply only if the method returns in time,
+// so that a late method never races with the response. Its panics are
+// propagated to the caller like in callMethod, or logged once it timed out.
+func callMethodWithTimeout(ctx context.Context, method reflect.Value, in []reflect.Value, recoverAll bool) []reflect.Value {
+	reply := in[len(in)-1]
+	private := reflect.New(reply.Type().Elem())
+	in = append(in[:len(in)-1:len(in)-1], private)
+
+	done := make(chan methodResult, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				res := methodResult{panicked: true, value: v}
+				if panicError(v) == nil {
+					res.stack = debug.Stack()
+				}
+				done <- res
+			}
+		}()
+		done <- methodResult{out: method.Call(in)}
+	}()
+
+	for {
+		select {
+		case res := <-done:
+			if res.panicked {
+				return methodPanicked(res.value, res.stack, recoverAll)
+			}
+			reply.Elem().Set(private.Elem())
+			return res.out
+		case <-ctx.Done():
+			if ctx.Err() != context.DeadlineExceeded {
+				// Canceled for another reason, e.g. an exceeded cost
+				// budget: the method reports it itself.
+				continue
+			}
+			go func() {
+				if res := <-done; res.panicked {
+					log.Printf("rpc: panic calling method after its timeout: %v\n%s", res.value, res.stack)
+				}
+			}()
+			return []reflect.Value{reflect.ValueOf(ErrMethodTimeout)}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package gorilla/rpc/wsrpc serves JSON-RPC over WebSocket connections.
+
+Each text message received on a connection is served by a RPC server as if it
+had been sent in the body of an HTTP POST request, and the response, if any,
+is sent back as a text message:
+
+	import (
+		"http"
+		"github.com/gorilla/rpc/v2"
+		"github.com/gorilla/rpc/v2/json2"
+		"github.com/gorilla/rpc/v2/wsrpc"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(json2.NewCodec(), "application/json")
+		// [...]
+		http.Handle("/rpc", s)
+		http.Handle("/ws", wsrpc.NewHandler(s))
+	}
+
+Requests of a connection are served concurrently, up to Handler.MaxInFlight
+at a time, so their responses can be sent in any order. Notifications don't
+get a response. Messages larger than Handler.ReadLimit close the connection.
+
+Connections are pinged every Handler.PingPeriod, and closed once they stay
+silent, without a message or pong, for longer than Handler.PongWait, or when
+a message can't be written within Handler.WriteWait.
+
+The methods called over a connection can push notifications to the client
+with the Conn returned by ConnFromContext, for as long as the connection is
+open:
+
+	func (s *Service) Subscribe(r *http.Request, args *Args, reply *bool) error {
+		conn := wsrpc.ConnFromContext(r.Context())
+		if conn == nil {
+			return errors.New("subscriptions need a WebSocket connection")
+		}
+		go func() {
+			for event := range s.events() {
+				if err := conn.Notify("event", event); err != nil {
+					return
+				}
+			}
+		}()
+		*reply = true
+		return nil
+	}
+*/
+package wsrpc
@@ -0,0 +1,279 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wsrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrConnClosed is returned when pushing to a connection that is closed.
+var ErrConnClosed = errors.New("wsrpc: connection closed")
+
+const (
+	// DefaultReadLimit is the default maximum size of a message, see
+	// Handler.ReadLimit.
+	DefaultReadLimit = 1 << 20
+	// DefaultMaxInFlight is the default maximum number of messages served
+	// concurrently per connection, see Handler.MaxInFlight.
+	DefaultMaxInFlight = 16
+	// DefaultWriteWait is the default time allowed to write a message, see
+	// Handler.WriteWait.
+	DefaultWriteWait = 10 * time.Second
+	// DefaultPongWait is the default time allowed to read the next message
+	// or pong, see Handler.PongWait.
+	DefaultPongWait = 60 * time.Second
+)
+
+// Handler upgrades HTTP requests to WebSocket connections and serves the
+// JSON-RPC requests received on them.
+type Handler struct {
+	// Server serves the requests, usually a *rpc.Server.
+	Server http.Handler
+	// Upgrader upgrades the HTTP requests, e.g. to check their origin.
+	Upgrader websocket.Upgrader
+	// ContentType is the Content-Type of the requests passed to Server,
+	// selecting its codec. It defaults to "application/json".
+	ContentType string
+	// ReadLimit is the maximum size in bytes of a message. A connection
+	// receiving a larger message is closed. It defaults to
+	// DefaultReadLimit.
+	ReadLimit int64
+	// MaxInFlight is the maximum number of messages of a connection served
+	// concurrently. Once reached, no more messages are read until one of
+	// them is served. It defaults to DefaultMaxInFlight.
+	MaxInFlight int
+	// WriteWait is the time allowed to write a message to a connection,
+	// closed if it can't keep up. It defaults to DefaultWriteWait.
+	WriteWait time.Duration
+	// PongWait is the time allowed to read the next message or pong of a
+	// connection, closed if it stays silent longer. It defaults to
+	// DefaultPongWait.
+	PongWait time.Duration
+	// PingPeriod is the period of the pings sent to keep connections alive.
+	// It must be less than PongWait, and defaults to 9/10 of it.
+	PingPeriod time.Duration
+}
+
+// NewHandler returns a Handler serving the requests with server.
+func NewHandler(server http.Handler) *Handler {
+	return &Handler{Server: server}
+}
+
+// ServeHTTP upgrades r and serves the connection until it is closed.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an HTTP error.
+		return
+	}
+	readLimit := h.ReadLimit
+	if readLimit <= 0 {
+		readLimit = DefaultReadLimit
+	}
+	ws.SetReadLimit(readLimit)
+	maxInFlight := h.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = DefaultMaxInFlight
+	}
+	inFlight := make(chan struct{}, maxInFlight)
+	writeWait := h.WriteWait
+	if writeWait <= 0 {
+		writeWait = DefaultWriteWait
+	}
+	pongWait := h.PongWait
+	if pongWait <= 0 {
+		pongWait = DefaultPongWait
+	}
+	pingPeriod := h.PingPeriod
+	if pingPeriod <= 0 || pingPeriod >= pongWait {
+		pingPeriod = pongWait * 9 / 10
+	}
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	ctx, cancel := context.WithCancel(r.Context())
+	conn := &Conn{ws: ws, ctx: ctx, writeWait: writeWait}
+	ctx = context.WithValue(ctx, connKey{}, conn)
+	go conn.keepAlive(pingPeriod)
+
+	var wg sync.WaitGroup
+	for {
+		inFlight <- struct{}{}
+		// The time spent waiting for a message to be served doesn't count.
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			h.serveMessage(conn, r.WithContext(ctx), message)
+		}()
+	}
+	cancel()
+	wg.Wait()
+	conn.Close()
+}
+
+// serveMessage serves a request received on conn, r being the request of
+// the connection.
+func (h *Handler) serveMessage(conn *Conn, r *http.Request, message []byte) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("wsrpc: panic serving request: %v\n%s", v, debug.Stack())
+		}
+	}()
+
+	contentType := h.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req := r.Clone(r.Context())
+	req.Method = "POST"
+	req.Header.Set("Content-Type", contentType)
+	// The response is sent in a message as a whole, and each message is a
+	// request of its own.
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Idempotency-Key")
+	req.Body = ioutil.NopCloser(bytes.NewReader(message))
+	req.ContentLength = int64(len(message))
+
+	rw := &messageResponseWriter{header: make(http.Header)}
+	h.Server.ServeHTTP(rw, req)
+	if response := bytes.TrimSpace(rw.body.Bytes()); len(response) != 0 {
+		conn.write(response)
+	}
+}
+
+// messageResponseWriter records the response of a request received in a
+// message. Its headers and status code are discarded.
+type messageResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *messageResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *messageResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *messageResponseWriter) WriteHeader(status int) {}
+
+// ----------------------------------------------------------------------------
+// Conn
+// ----------------------------------------------------------------------------
+
+type connKey struct{}
+
+// ConnFromContext returns the connection a request was received on, or nil
+// if it wasn't received over WebSocket.
+func ConnFromContext(ctx context.Context) *Conn {
+	conn, _ := ctx.Value(connKey{}).(*Conn)
+	return conn
+}
+
+// Conn is a WebSocket connection served by a Handler.
+type Conn struct {
+	ws        *websocket.Conn
+	ctx       context.Context
+	writeWait time.Duration
+	mutex     sync.Mutex
+	closed    bool
+}
+
+// notification is a JSON-RPC notification pushed by the server.
+type notification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// Notify pushes a JSON-RPC notification calling method with params to the
+// client. It is safe to call from several goroutines.
+func (c *Conn) Notify(method string, params interface{}) error {
+	message, err := json.Marshal(&notification{
+		Version: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	return c.write(message)
+}
+
+// Done returns a channel closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.ws.Close()
+}
+
+// write sends message in a text message. The connection is closed if it
+// can't be written within its write wait.
+func (c *Conn) write(message []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrConnClosed
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(c.writeWait))
+	if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+		c.closed = true
+		c.ws.Close()
+		return err
+	}
+	return nil
+}
+
+// keepAlive pings the client every period until the connection is closed.
+// A ping that can't be written closes the connection.
+func (c *Conn) keepAlive(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			// WriteControl can be called concurrently with write, so that a
+			// blocked write doesn't hold pings back.
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeWait)); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
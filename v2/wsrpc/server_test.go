@@ -0,0 +1,229 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wsrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/gorilla/websocket"
+)
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1Response struct {
+	Result int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return nil
+}
+
+func (t *Service1) Subscribe(r *http.Request, req *Service1Request, res *bool) error {
+	conn := ConnFromContext(r.Context())
+	if conn == nil {
+		return errors.New("no connection")
+	}
+	go conn.Notify("Service1.Event", &Service1Response{req.A})
+	*res = true
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	server := httptest.NewServer(NewHandler(s))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// A notification doesn't get a response.
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 1, "B": 1}}`))
+
+	request, _ := json2.EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	if err := ws.WriteMessage(websocket.TextMessage, request); err != nil {
+		t.Fatal(err)
+	}
+	messageType, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.TextMessage {
+		t.Errorf("Expected a text message, but got type %d", messageType)
+	}
+	var res Service1Response
+	if err := json2.DecodeClientResponse(strings.NewReader(string(message)), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, but got %d, err: %v", res.Result, err)
+	}
+
+	// Server pushes are sent as notifications.
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Service1.Subscribe", "params": {"A": 7}}`))
+	_, message, err = ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var push struct {
+		Method string
+		Params Service1Response
+	}
+	if err := json.Unmarshal(message, &push); err != nil || push.Method != "Service1.Event" || push.Params.Result != 7 {
+		t.Errorf("Unexpected push %s, err: %v", message, err)
+	}
+}
+
+type BlockingService struct {
+	mutex     sync.Mutex
+	active    int
+	maxActive int
+	release   chan struct{}
+}
+
+func (t *BlockingService) Block(r *http.Request, req *Service1Request, res *int) error {
+	t.mutex.Lock()
+	t.active++
+	if t.active > t.maxActive {
+		t.maxActive = t.active
+	}
+	t.mutex.Unlock()
+	<-t.release
+	t.mutex.Lock()
+	t.active--
+	t.mutex.Unlock()
+	*res = req.A
+	return nil
+}
+
+func TestHandlerLimits(t *testing.T) {
+	service := &BlockingService{release: make(chan struct{})}
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(service, "")
+	handler := NewHandler(s)
+	handler.MaxInFlight = 1
+	handler.ReadLimit = 512
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Messages over the in-flight limit wait to be read.
+	for i := 1; i <= 2; i++ {
+		request, _ := json2.EncodeClientRequest("BlockingService.Block", &Service1Request{A: i})
+		if err := ws.WriteMessage(websocket.TextMessage, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(service.release)
+	for i := 0; i < 2; i++ {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if service.maxActive != 1 {
+		t.Errorf("Expected 1 message served at a time, but got %d", service.maxActive)
+	}
+
+	// A message over the read limit closes the connection.
+	request, _ := json2.EncodeClientRequest("BlockingService.Block", strings.Repeat("x", 1024))
+	if err := ws.WriteMessage(websocket.TextMessage, request); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestHandlerKeepAlive(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	handler := NewHandler(s)
+	handler.PongWait = 100 * time.Millisecond
+	handler.PingPeriod = 20 * time.Millisecond
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// A client reading its messages answers the pings, and stays connected.
+	alive, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	messages := make(chan []byte, 1)
+	go func() {
+		for {
+			_, message, err := alive.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- message
+		}
+	}()
+
+	// A client that doesn't read never answers, and gets disconnected.
+	silent, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	request, _ := json2.EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	if err := alive.WriteMessage(websocket.TextMessage, request); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message, ok := <-messages:
+		var res Service1Response
+		if !ok {
+			t.Fatal("Expected the connection to stay open")
+		} else if err := json2.DecodeClientResponse(strings.NewReader(string(message)), &res); err != nil || res.Result != 8 {
+			t.Errorf("Expected 8, but got %d, err: %v", res.Result, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a response")
+	}
+
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	for {
+		if _, _, err := silent.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the connection to be closed, but it was still open after %s", elapsed)
+	}
+}